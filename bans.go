@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxBansPerRequest is the largest page GuildBans accepts.
+const maxBansPerRequest = 1000
+
+var (
+	guildBansGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_bans_count",
+			Help: "Number of users banned from the Discord server",
+		},
+		[]string{"guild"},
+	)
+	// noBanPermissionLogged keeps the missing permission warning to one per
+	// guild.
+	noBanPermissionLogged sync.Map
+)
+
+// updateBanCount pages through the bans of the guild and sets
+// discord_guild_bans_count. Listing bans needs the Ban Members permission; a
+// guild where the bot lacks it is skipped with a single warning and not
+// counted as a failure.
+func updateBanCount(ctx context.Context, discordSession discordClient, serverID string) bool {
+	total := 0
+	after := ""
+	for {
+		bans, err := withRetry(ctx, "get guild bans", func() ([]*discordgo.GuildBan, error) {
+			apiRequestsCounter.WithLabelValues("GuildBans").Inc()
+			return discordSession.GuildBans(serverID, maxBansPerRequest, "", after, discordgo.WithContext(ctx))
+		})
+		if isForbidden(err) {
+			if _, logged := noBanPermissionLogged.LoadOrStore(serverID, true); !logged {
+				slog.Warn("Missing the Ban Members permission, skipping discord_guild_bans_count", "guild", serverID)
+			}
+			guildBansGauge.DeleteLabelValues(serverID)
+			return true
+		}
+		if err != nil {
+			scrapeErrorsCounter.WithLabelValues(metricGroupGuild).Inc()
+			slog.Error("Failed to get guild bans", "guild", serverID, "error", err)
+			return false
+		}
+
+		total += len(bans)
+		if len(bans) < maxBansPerRequest {
+			break
+		}
+		// after で ID 順に次のページを取得する
+		after = bans[len(bans)-1].User.ID
+	}
+	noBanPermissionLogged.Delete(serverID)
+	guildBansGauge.WithLabelValues(serverID).Set(float64(total))
+	return true
+}
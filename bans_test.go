@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateBanCountPaginates(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	for i := 1; i <= 2500; i++ {
+		fake.bans["g1"] = append(fake.bans["g1"], &discordgo.GuildBan{User: &discordgo.User{ID: fmt.Sprint(i)}})
+	}
+
+	if !updateBanCount(context.Background(), fake, "g1") {
+		t.Fatal("updateBanCount failed")
+	}
+	wantSeries(t, guildBansGauge, prometheus.Labels{"guild": "g1"}, 2500)
+	// 1000 件、1000 件、500 件の 3 ページ
+	if got := fake.callCount("GuildBans"); got != 3 {
+		t.Errorf("GuildBans called %d times, want 3", got)
+	}
+}
+
+func TestUpdateBanCountWithoutPermission(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	guildBansGauge.WithLabelValues("g1").Set(4)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		return restError(http.StatusForbidden)
+	}
+
+	// 権限がないのは失敗として扱わず、系列を消す
+	if !updateBanCount(context.Background(), fake, "g1") {
+		t.Error("updateBanCount reported a failure without the Ban Members permission")
+	}
+	wantNoSeries(t, guildBansGauge, prometheus.Labels{"guild": "g1"})
+}
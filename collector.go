@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHitsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_cache_hits_total",
+		Help: "Number of collectOnScrape scrapes served from the last cycle within cacheTTL",
+	})
+	cacheMissesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_cache_misses_total",
+		Help: "Number of collectOnScrape scrapes that ran a collection cycle",
+	})
+)
+
+// discordCollector exposes the Discord metrics of the enabled metric groups.
+// By default it serves the values set by the last timed collection cycle. With
+// collectOnScrape, every scrape runs a cycle first, so the values line up with
+// the Prometheus scrape timing. With cacheTTL, scrapes within that duration
+// of the last such cycle serve its values instead of running another.
+type discordCollector struct {
+	collectors []prometheus.Collector
+	onScrape   bool
+	cacheTTL   time.Duration
+	// fetchedAt is when the last cycle run by a scrape finished. It is
+	// guarded by cycleMu.
+	fetchedAt time.Time
+}
+
+func newDiscordCollector(config *Config) *discordCollector {
+	c := &discordCollector{onScrape: config.CollectOnScrape, cacheTTL: config.CacheTTL}
+	if config.MetricEnabled(metricGroupMembers) {
+		c.collectors = append(c.collectors, memberCountGauge, memberDeltaGauge, membersByTypeGauge, membersWithFlagGauge)
+	}
+	if config.ActivityTopN > 0 {
+		c.collectors = append(c.collectors, membersByActivityGauge)
+	}
+	if config.MetricEnabled(metricGroupMembers) && config.CountRoles {
+		c.collectors = append(c.collectors, membersByRoleGauge)
+	}
+	if config.CountOnline {
+		c.collectors = append(c.collectors, membersOnlineGauge)
+	}
+	if config.CountVoiceMembers {
+		c.collectors = append(c.collectors, voiceChannelMembersGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) {
+		c.collectors = append(c.collectors,
+			messageCountTotalGauge,
+			threadMessageCountGauge,
+			keywordMessageCountGauge,
+			messageRateGauge,
+			messagesLastIntervalGauge,
+			messageAccelerationGauge,
+			observedMessageCountGauge,
+			lastMessagePositionGauge,
+			lastMessageTimestampGauge,
+			channelCreatedTimestampGauge,
+			reactionsPerMessageGauge,
+			reactionCountGauge,
+			emojiUsedCountGauge,
+			mentionsCountGauge,
+			orphanedRepliesGauge,
+			editedMessagesGauge,
+			messagesByAuthorTypeGauge,
+			pinnedMessageCountGauge,
+			circuitOpenGauge,
+			categoryCountGauge,
+			channelsPerSecondGauge,
+			channelsProcessedGauge,
+			channelsTotalGauge,
+			channelsNoAccessGauge,
+			channelsExcludedGauge,
+			channelsExcludedUnmatchedGauge,
+			messageCountDistribution,
+		)
+		if config.MessageAgeHistogram {
+			c.collectors = append(c.collectors, messageAgeHistogram)
+		}
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.EmitPerChannelMessages {
+		c.collectors = append(c.collectors, messageCountGauge, recentMessageCountGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.CountAttachments {
+		c.collectors = append(c.collectors, attachmentCountTotalGauge, embedCountTotalGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.EmitPerChannelAttachments {
+		c.collectors = append(c.collectors, attachmentCountGauge, embedCountGauge)
+	}
+	if config.MetricEnabled(metricGroupMembers) && config.MetricEnabled(metricGroupMessages) {
+		c.collectors = append(c.collectors, messagesPerMemberGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.TopTalkers > 0 {
+		c.collectors = append(c.collectors, userMessageCountGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.NormalizeChannelLabels {
+		c.collectors = append(c.collectors, channelInfoGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.CountRoleID != "" {
+		c.collectors = append(c.collectors, roleMessageCountGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.MessagesPerDay > 0 {
+		c.collectors = append(c.collectors, messagesPerDayGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.TopReactionEmoji > 0 {
+		c.collectors = append(c.collectors, emojiReactionCountGauge)
+	}
+	if config.MetricEnabled(metricGroupMessages) && config.MaxMessagePagesPerChannel > 0 {
+		c.collectors = append(c.collectors, messageCountCappedGauge)
+	}
+	if config.MetricEnabled(metricGroupGuild) {
+		c.collectors = append(c.collectors,
+			guildHasIconGauge,
+			guildHasBannerGauge,
+			guildHasVanityURLGauge,
+			guildDefaultNotificationsGauge,
+			guildPremiumTierGauge,
+			guildPremiumSubscriptionsGauge,
+			channelsCountGauge,
+			rolesCountGauge,
+		)
+	}
+	if config.MetricEnabled(metricGroupGuild) && config.CountBans {
+		c.collectors = append(c.collectors, guildBansGauge)
+	}
+	if config.MetricEnabled(metricGroupGuild) && config.CountInvites {
+		c.collectors = append(c.collectors, inviteUsesGauge)
+	}
+	return c
+}
+
+func (c *discordCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(ch)
+	}
+}
+
+func (c *discordCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.onScrape {
+		// 同時のスクレイプがそれぞれ Discord から取得しないよう cycleMu で直列化する
+		cycleMu.Lock()
+		defer cycleMu.Unlock()
+		switch {
+		case collectorPaused.Load():
+			slog.Info("Collector is paused, serving the last values")
+		// 失敗したサイクルもキャッシュし、Discord が落ちている間に毎回取得しない
+		case c.cacheTTL > 0 && time.Since(c.fetchedAt) < c.cacheTTL:
+			cacheHitsCounter.Inc()
+		default:
+			if c.cacheTTL > 0 {
+				cacheMissesCounter.Inc()
+			}
+			runRecoveredCycle(context.Background(), discordSession, serverIDs)
+			c.fetchedAt = time.Now()
+		}
+	}
+	for _, collector := range c.collectors {
+		collector.Collect(ch)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectOnScrapeServesCache(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CollectOnScrape = true
+	// サイクルが TTL より長くかかっても、終了から TTL 以内のスクレイプはキャッシュを返す
+	cfg.CacheTTL = 100 * time.Millisecond
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 3, 0)
+	fake.addChannel("g1", "101", "general", 2)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildChannels" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return nil
+	}
+	discordSession = fake
+	t.Cleanup(func() { discordSession = nil })
+
+	registry := prometheus.NewRegistry()
+	if err := registerMetrics(registry, cfg); err != nil {
+		t.Fatal(err)
+	}
+	hits, misses := testutil.ToFloat64(cacheHitsCounter), testutil.ToFloat64(cacheMissesCounter)
+
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.totalCalls()
+	if calls == 0 {
+		t.Fatal("the first scrape didn't run a cycle")
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.totalCalls(); got != calls {
+		t.Errorf("Discord calls = %d after the second scrape, want %d from the cached cycle", got, calls)
+	}
+	if got := testutil.ToFloat64(cacheMissesCounter) - misses; got != 1 {
+		t.Errorf("cache misses = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheHitsCounter) - hits; got != 1 {
+		t.Errorf("cache hits = %v, want 1", got)
+	}
+}
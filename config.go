@@ -0,0 +1,1077 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// envPrefix is prepended to upper-cased config keys to form their environment
+// variables, e.g. DISCORD_EXPORTER_SERVERID for serverID.
+const envPrefix = "DISCORD_EXPORTER"
+
+// tokenEnv is read for the token when tokenFile is not set, ahead of the token
+// key.
+const tokenEnv = "DISCORD_TOKEN"
+
+type configKind int
+
+const (
+	stringKey configKind = iota
+	boolKey
+	intKey
+	listKey
+	mapKey
+	// blockListKey is a list of blocks of settings. It can only be set in the
+	// config file and gets no flag.
+	blockListKey
+)
+
+// configKey describes a config key. Every key can be set, in increasing order
+// of precedence, by its default, the config file, its environment variable and
+// a command line flag of the same name. Secrets get no flag so that they don't
+// show up in the process list.
+type configKey struct {
+	name   string
+	kind   configKind
+	def    any
+	secret bool
+	usage  string
+}
+
+var configKeys = []configKey{
+	{name: "overrideConfig", usage: "path of a config file whose settings override those of the config file"},
+	{name: "token", secret: true, usage: "Discord bot token"},
+	{name: "tokenFile", usage: "read the Discord bot token from this file, e.g. a mounted secret"},
+	{name: "serverID", usage: "ID of the Discord server to monitor"},
+	{name: "serverIDs", usage: "comma-separated IDs of the Discord servers to monitor, in addition to serverID"},
+	{name: "metrics", kind: listKey, def: defaultMetricGroups, usage: "metric groups to collect"},
+	{name: "includeChannels", usage: "comma-separated names or IDs of the only channels to count"},
+	{name: "excludeChannels", def: defaultExcludedChannels, usage: "names of channels not to count, comma-separated or a YAML list"},
+	{name: "excludeCaseInsensitive", kind: boolKey, usage: "match excludeChannels regardless of case"},
+	{name: "guilds", kind: blockListKey, usage: "blocks of serverID, includeChannels, excludeChannels and interval overriding the channel filters and message count interval of single servers (config file only)"},
+	{name: "excludeChannelIDs", usage: "comma-separated IDs of channels not to count"},
+	{name: "normalizeChannelLabels", kind: boolKey, usage: "lowercase channel labels and replace everything but a-z, 0-9 and _ with underscores"},
+	{name: "excludeChannelsRegex", kind: listKey, usage: "don't count channels whose name matches any of these regular expressions"},
+	{name: "keywordPatterns", kind: listKey, usage: "count messages matching these regular expressions"},
+	{name: "memberFlags", kind: listKey, usage: "count members with these public user flags"},
+	{name: "messageCountBuckets", kind: listKey, def: defaultMessageCountBuckets, usage: "bucket upper bounds of discord_channel_message_count_distribution"},
+	{name: "messageAgeHistogram", kind: boolKey, usage: "export the age of the counted messages as the discord_message_age_seconds histogram"},
+	{name: "messageAgeBuckets", kind: listKey, def: defaultMessageAgeBuckets, usage: "bucket upper bounds of discord_message_age_seconds, in seconds"},
+	{name: "countReactions", kind: boolKey, usage: "tally reactions while scanning messages"},
+	{name: "topReactionEmoji", kind: intKey, usage: "count the reactions with the N most used emoji per channel (needs countReactions)"},
+	{name: "customEmojiOnly", kind: boolKey, usage: "only count custom emoji for topReactionEmoji"},
+	{name: "countEmoji", kind: boolKey, usage: "count emoji used in message content"},
+	{name: "countMentions", kind: boolKey, usage: "count mentions in messages"},
+	{name: "countEdited", kind: boolKey, usage: "count messages that have been edited"},
+	{name: "countPinned", kind: boolKey, usage: "count the pinned messages of each channel (one extra request per channel)"},
+	{name: "countAuthorTypes", kind: boolKey, usage: "count messages by author type, human or bot"},
+	{name: "countAttachments", kind: boolKey, usage: "count the attachments and embeds of messages"},
+	{name: "emitPerChannelMessages", kind: boolKey, def: true, usage: "export the message count of every channel, not only the server totals"},
+	{name: "emitPerChannelAttachments", kind: boolKey, def: true, usage: "export the attachment and embed counts of every channel, not only the server totals"},
+	{name: "countOrphanedReplies", kind: boolKey, usage: "count replies to deleted messages"},
+	{name: "activityTopN", kind: intKey, usage: "count members by activity for the N most common activities (needs the presence intent)"},
+	{name: "messagePageSize", kind: intKey, def: maxMessagesPerRequest, usage: "messages fetched per request when counting a channel, between 1 and 100"},
+	{name: "maxMessagePagesPerChannel", kind: intKey, usage: "stop counting a channel after this many pages of messagePageSize messages (0 for no limit)"},
+	{name: "topTalkers", kind: intKey, usage: "count the messages of the N most active users per channel"},
+	{name: "countRoles", kind: boolKey, usage: "count the members holding each role"},
+	{name: "countRoleID", usage: "count the messages per channel posted by members holding this role (lists the members every cycle)"},
+	{name: "countVoiceMembers", kind: boolKey, usage: "count the members connected to each voice channel (opens a gateway connection)"},
+	{name: "countBans", kind: boolKey, usage: "count the users banned from each server (needs the Ban Members permission and the guild group)"},
+	{name: "countInvites", kind: boolKey, usage: "export the uses of each invite (needs the Manage Server permission and the guild group)"},
+	{name: "countOnline", kind: boolKey, usage: "count members that are online (needs the presence intent)"},
+	{name: "lastMessagePosition", kind: boolKey, usage: "export each channel's last message ID as a growth proxy"},
+	{name: "peerURL", usage: "bootstrap message counts from this peer exporter's metrics endpoint at startup"},
+	{name: "sqlitePath", usage: "append each cycle's counts to this SQLite database"},
+	{name: "skipStartupCheck", kind: boolKey, usage: "don't verify the token and server access at startup"},
+	{name: "collectOnScrape", kind: boolKey, usage: "run a collection cycle on every scrape instead of every updateInterval"},
+	{name: "cacheTTL", usage: "with collectOnScrape, serve the values of the last cycle to scrapes within this duration of it"},
+	{name: "includeThreads", kind: boolKey, usage: "count the messages of active threads and forum posts"},
+	{name: "incrementalCount", kind: boolKey, usage: "only page through messages posted since the previous cycle and add them to a running total"},
+	{name: "messagesPerDay", kind: intKey, usage: "count the messages of each channel posted on each of the last N days"},
+	{name: "messagesPerDayTimezone", def: "UTC", usage: "time zone the days of messagesPerDay start and end in, e.g. Asia/Tokyo"},
+	{name: "messageLookback", usage: "only count messages posted within this duration, as discord_recent_message_count"},
+	{name: "updateInterval", def: defaultUpdateInterval.String(), usage: "interval between collection cycles"},
+	{name: "cycleTimeout", usage: "abort a collection cycle that runs longer than this (default updateInterval)"},
+	{name: "scrapeJitter", usage: "delay the first collection cycle by a random duration up to this one"},
+	{name: "mode", def: modeServe, usage: "\"serve\" the metrics over HTTP, or \"push\" them to pushgatewayURL after a single cycle and exit"},
+	{name: "pushgatewayURL", usage: "URL of the Pushgateway to push to in push mode"},
+	{name: "pushJob", def: defaultPushJob, usage: "job name to push the metrics under in push mode"},
+	{name: "metricsPort", def: defaultMetricsPort, usage: "listen address of the metrics server, \":PORT\" or \"host:port\""},
+	{name: "tlsCertFile", usage: "serve HTTPS with this certificate file (needs tlsKeyFile)"},
+	{name: "tlsKeyFile", usage: "private key file of tlsCertFile"},
+	{name: "enableOpenMetrics", kind: boolKey, usage: "serve the OpenMetrics format on /metrics to scrapers that negotiate it"},
+	{name: "constantLabels", kind: mapKey, usage: "labels added to every metric, e.g. env=prod,region=eu"},
+	{name: "metricNamespace", usage: "prefix all metric names with this namespace, e.g. myorg for myorg_discord_members_count"},
+	{name: "pathPrefix", usage: "serve all HTTP routes below this path"},
+	{name: "readTimeout", def: defaultReadTimeout.String(), usage: "read timeout of the metrics server"},
+	{name: "writeTimeout", def: defaultWriteTimeout.String(), usage: "write timeout of the metrics server"},
+	{name: "idleTimeout", def: defaultIdleTimeout.String(), usage: "idle timeout of the metrics server"},
+	{name: "maxConcurrentChannels", kind: intKey, def: defaultMaxConcurrentChannels, usage: "number of channels counted concurrently"},
+	{name: "onChannelError", def: onChannelErrorKeep, usage: "what happens to the series of a channel that failed to count: \"keep\" or \"clear\""},
+	{name: "maxRetries", kind: intKey, def: defaultMaxRetries, usage: "retries of a failed Discord API request before giving up"},
+	{name: "httpProxy", usage: "send Discord API requests through this proxy, e.g. http://proxy:3128 or socks5://proxy:1080"},
+	{name: "httpTimeout", def: defaultHTTPTimeout.String(), usage: "timeout of a single Discord API request"},
+	{name: "staleAfterIntervals", def: defaultStaleAfterIntervals, usage: "update intervals without a completed cycle before /health/fresh fails"},
+	{name: "logFormat", def: defaultLogFormat, usage: "log format, \"text\" or \"json\""},
+	{name: "logLevel", def: defaultLogLevel, usage: "minimum log level: debug, info, warn or error"},
+	{name: "adminToken", secret: true, usage: "bearer token enabling the admin endpoints"},
+	{name: "metricsUsername", usage: "require HTTP basic auth with this username on /metrics"},
+	{name: "metricsPassword", secret: true, usage: "password of the HTTP basic auth on /metrics"},
+}
+
+// maxKeywordPatterns bounds keywordPatterns, since every pattern adds one
+// discord_keyword_messages_count series per channel.
+const maxKeywordPatterns = 10
+
+// maxMemberFlags bounds memberFlags, each of which adds one
+// discord_members_with_flag_count series per guild.
+const maxMemberFlags = 5
+
+// memberFlags maps the names accepted in the memberFlags config key to the
+// public user flags they count.
+var memberFlags = map[string]discordgo.UserFlags{
+	"discord_employee":       discordgo.UserFlagDiscordEmployee,
+	"discord_partner":        discordgo.UserFlagDiscordPartner,
+	"hypesquad_events":       discordgo.UserFlagHypeSquadEvents,
+	"bug_hunter_level_1":     discordgo.UserFlagBugHunterLevel1,
+	"house_bravery":          discordgo.UserFlagHouseBravery,
+	"house_brilliance":       discordgo.UserFlagHouseBrilliance,
+	"house_balance":          discordgo.UserFlagHouseBalance,
+	"early_supporter":        discordgo.UserFlagEarlySupporter,
+	"bug_hunter_level_2":     discordgo.UserFlagBugHunterLevel2,
+	"verified_bot":           discordgo.UserFlagVerifiedBot,
+	"verified_bot_developer": discordgo.UserFlagVerifiedBotDeveloper,
+	"certified_moderator":    discordgo.UserFlagDiscordCertifiedModerator,
+}
+
+// metricNamespacePattern matches the namespaces that form valid metric names.
+var metricNamespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+const defaultStaleAfterIntervals = 3
+
+const defaultMetricsPort = ":2112"
+
+// onChannelError values: keep the previous series of a channel that failed to
+// count, or clear them.
+const (
+	onChannelErrorKeep  = "keep"
+	onChannelErrorClear = "clear"
+)
+
+const (
+	defaultReadTimeout  = 10 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+	defaultIdleTimeout  = 60 * time.Second
+	defaultHTTPTimeout  = 30 * time.Second
+)
+
+// Metric groups that can be listed in the metrics config key.
+const (
+	metricGroupMembers  = "members"
+	metricGroupMessages = "messages"
+	metricGroupGuild    = "guild"
+)
+
+var (
+	knownMetricGroups   = []string{metricGroupMembers, metricGroupMessages, metricGroupGuild}
+	defaultMetricGroups = []string{metricGroupMembers, metricGroupMessages}
+)
+
+// defaultExcludedChannels are the channels skipped when excludeChannels is not
+// configured.
+const defaultExcludedChannels = "パダワン部屋,入室通知"
+
+var defaultMessageCountBuckets = []float64{100, 1000, 10000, 100000, 1000000}
+
+// defaultMessageAgeBuckets are an hour, a day, a week, 30 days and a year.
+var defaultMessageAgeBuckets = []float64{3600, 86400, 604800, 2592000, 31536000}
+
+type Config struct {
+	Token string
+	// ServerIDs are the guilds to monitor: serverID followed by serverIDs,
+	// without duplicates.
+	ServerIDs       []string
+	KeywordPatterns []*regexp.Regexp
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	UpdateInterval  time.Duration
+	// CycleTimeout bounds a collection cycle, or zero to bound it by the
+	// current UpdateInterval instead.
+	CycleTimeout time.Duration
+	// ScrapeJitter is the upper bound of the random delay before the first
+	// collection cycle, or zero to start right away.
+	ScrapeJitter time.Duration
+	// HTTPTimeout bounds every Discord API request, so a stuck connection
+	// can't stall a worker.
+	HTTPTimeout time.Duration
+	// HTTPProxy is the proxy for the Discord API and gateway connections.
+	// When nil, the standard proxy environment variables apply.
+	HTTPProxy *url.URL
+	// Mode is modeServe or modePush. PushgatewayURL and PushJob are only used
+	// in push mode.
+	Mode           string
+	PushgatewayURL string
+	PushJob        string
+	// MessageLookback limits message counting to the messages posted within
+	// this duration. Zero counts the full history.
+	MessageLookback      time.Duration
+	MetricsPort          string
+	PathPrefix           string
+	SQLitePath           string
+	PeerURL              string
+	CountReactions       bool
+	CountEmoji           bool
+	CountMentions        bool
+	CountOrphanedReplies bool
+	CountEdited          bool
+	CountAttachments     bool
+	CountAuthorTypes     bool
+	CountPinned          bool
+	// EmitPerChannelMessages and EmitPerChannelAttachments export the
+	// per-channel series of the message and attachment counts. Without them
+	// only the totals per guild are exported.
+	EmitPerChannelMessages    bool
+	EmitPerChannelAttachments bool
+	// StaleAfterIntervals is how many update intervals may pass without a
+	// completed cycle before /health/fresh reports unhealthy.
+	StaleAfterIntervals float64
+	// AdminToken enables the admin endpoints (/pause, /resume), which require
+	// it as a bearer token.
+	AdminToken string
+	// MetricsUsername and MetricsPassword, when set, protect /metrics with
+	// HTTP basic auth.
+	MetricsUsername string
+	MetricsPassword string
+	// TLSCertFile and TLSKeyFile, when set, make the metrics server serve
+	// HTTPS instead of plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// EnableOpenMetrics serves the OpenMetrics text format to scrapers that
+	// ask for it in their Accept header.
+	EnableOpenMetrics bool
+	// MessageCountBuckets are the upper bounds of the
+	// discord_channel_message_count_distribution histogram.
+	MessageCountBuckets []float64
+	// MessageAgeHistogram enables discord_message_age_seconds with the upper
+	// bounds MessageAgeBuckets.
+	MessageAgeHistogram bool
+	MessageAgeBuckets   []float64
+	// LastMessagePosition exports each channel's LastMessageID snowflake as a
+	// cheap growth proxy. It is not a message count.
+	LastMessagePosition bool
+	// ActivityTopN enables discord_members_by_activity for the N most common
+	// activities. It requires a gateway connection with the presence intent.
+	ActivityTopN int
+	// MessagesPerDay enables discord_messages_per_day for the last N
+	// calendar days in MessagesPerDayLocation.
+	MessagesPerDay         int
+	MessagesPerDayLocation *time.Location
+	// NormalizeChannelLabels labels channels by normalizeChannelLabel of
+	// their name, exporting the real names in discord_channel_info.
+	NormalizeChannelLabels bool
+	// TopTalkers enables discord_user_message_count for the N users with the
+	// most messages in each channel.
+	TopTalkers int
+	// TopReactionEmoji enables discord_emoji_reaction_count for the N emoji
+	// used most in the reactions of each channel, leaving out unicode emoji
+	// with CustomEmojiOnly.
+	TopReactionEmoji int
+	CustomEmojiOnly  bool
+	// MessagePageSize is the number of messages countChannelMessages requests
+	// per page, at most maxMessagesPerRequest.
+	MessagePageSize int
+	// MaxMessagePagesPerChannel caps the pages countChannelMessages fetches
+	// per channel, or zero for no cap. A capped count is a lower bound.
+	MaxMessagePagesPerChannel int
+	// CountRoles enables discord_members_by_role_count, tallied from the
+	// members fetched for the member count.
+	CountRoles bool
+	// CountRoleID enables discord_role_message_count for the messages of
+	// members holding the role with this ID.
+	CountRoleID string
+	// CountBans enables discord_guild_bans_count in the guild group.
+	CountBans bool
+	// CountInvites enables discord_invite_uses in the guild group.
+	CountInvites bool
+	// CountOnline enables discord_members_online_count, which is also built
+	// from presences and needs the presence intent.
+	CountOnline bool
+	// CountVoiceMembers enables discord_voice_channel_members, built from the
+	// voice states delivered over the gateway.
+	CountVoiceMembers bool
+	// MemberFlags are the public user flag names counted during member
+	// iteration, see memberFlags.
+	MemberFlags []string
+	// IncludedChannels are the names and IDs of the channels counted. When
+	// empty, every channel is counted. The exclusions apply on top.
+	IncludedChannels map[string]struct{}
+	// ExcludedChannels and ExcludedChannelIDs are the channel names and IDs
+	// not counted. A channel matching either is excluded.
+	ExcludedChannels   map[string]struct{}
+	ExcludedChannelIDs map[string]struct{}
+	// ExcludeCaseInsensitive compares channel names with ExcludedChannels
+	// ignoring case. ExcludedChannels then holds the lowercased names.
+	ExcludeCaseInsensitive bool
+	// Guilds are the guilds blocks by server ID.
+	Guilds map[string]*GuildConfig
+	// ExcludedChannelPatterns exclude the channels whose name matches any of
+	// them, in addition to ExcludedChannels.
+	ExcludedChannelPatterns []*regexp.Regexp
+	// IncludeThreads counts active threads, including forum posts, as
+	// discord_thread_message_count.
+	IncludeThreads bool
+	// IncrementalCount keeps a running tally per channel and only pages
+	// through new messages after the first full count, see countNewMessages.
+	IncrementalCount bool
+	// SkipStartupCheck skips checkBotAccount and checkServerAccess, which
+	// otherwise stop the exporter before it starts serving.
+	SkipStartupCheck bool
+	// CollectOnScrape runs a collection cycle on every scrape instead of on
+	// a timer.
+	CollectOnScrape bool
+	// CacheTTL lets scrapes within this duration of the last collectOnScrape
+	// cycle serve its values instead of running another, or zero for none.
+	CacheTTL time.Duration
+	// MaxConcurrentChannels is the initial size of the channel worker pool.
+	MaxConcurrentChannels int
+	// MaxRetries is how often a failed Discord API request is retried, see
+	// withRetry.
+	MaxRetries int
+	// OnChannelError is onChannelErrorKeep or onChannelErrorClear.
+	OnChannelError string
+	// LogFormat and LogLevel configure the default slog logger, see
+	// newLogger.
+	LogFormat string
+	LogLevel  slog.Level
+	// MetricNamespace is prepended to every metric name, see MetricPrefix.
+	MetricNamespace string
+	// ConstantLabels are added to every metric of the exporter.
+	ConstantLabels map[string]string
+	// MetricGroups is the set of enabled metric groups.
+	MetricGroups map[string]bool
+}
+
+// GuildConfig is a block of the guilds key, which overrides the channel
+// filters and the message count interval for the guild ServerID.
+type GuildConfig struct {
+	ServerID string
+	// IncludedChannels and ExcludedChannels replace the global
+	// includeChannels and excludeChannels for the channels of the guild. They
+	// are nil when the block leaves them out and the global ones apply.
+	IncludedChannels map[string]struct{}
+	ExcludedChannels map[string]struct{}
+	// Interval is how often the messages of the guild are counted, a
+	// duration of at least UpdateInterval, or zero for every cycle.
+	Interval time.Duration
+}
+
+func (c *Config) MetricEnabled(group string) bool {
+	return c.MetricGroups[group]
+}
+
+// MetricPrefix is the prefix of all metric names: the namespace followed by an
+// underscore, or empty without a namespace.
+func (c *Config) MetricPrefix() string {
+	if c.MetricNamespace == "" {
+		return ""
+	}
+	return c.MetricNamespace + "_"
+}
+
+// bindConfigSources registers the defaults, environment variables and command
+// line flags of all configKeys with viper, which then resolves every key as
+// flag > env > file > default. It returns the config file path given with
+// --config or DISCORD_EXPORTER_CONFIG, if any.
+func bindConfigSources(args []string) (string, error) {
+	flags := pflag.NewFlagSet("discord-exporter", pflag.ContinueOnError)
+	configFile := flags.String("config", "", "path of the config file (default ./discord-exporter.yaml)")
+	flags.BoolVar(&checkConfigOnly, "check-config", false, "validate the configuration, print the resolved settings and exit")
+	flags.BoolVar(&listChannelsOnly, "list-channels", false, "print the name, ID and type of every channel of the configured servers and exit")
+	for _, key := range configKeys {
+		if key.def != nil {
+			viper.SetDefault(key.name, key.def)
+		}
+		if key.secret || key.kind == blockListKey {
+			continue
+		}
+		switch key.kind {
+		case boolKey:
+			flags.Bool(key.name, false, key.usage)
+		case intKey:
+			flags.Int(key.name, 0, key.usage)
+		case listKey:
+			flags.StringSlice(key.name, nil, key.usage)
+		case mapKey:
+			flags.StringToString(key.name, nil, key.usage)
+		default:
+			flags.String(key.name, "", key.usage)
+		}
+		if err := viper.BindPFlag(key.name, flags.Lookup(key.name)); err != nil {
+			return "", err
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+
+	viper.SetEnvPrefix(envPrefix)
+	viper.AutomaticEnv()
+	if *configFile == "" {
+		return os.Getenv(envPrefix + "_CONFIG"), nil
+	}
+	return *configFile, nil
+}
+
+// checkConfigOnly is set by --check-config. main then prints the resolved
+// settings with printConfig and exits without connecting to Discord.
+var checkConfigOnly bool
+
+// printConfig writes the value every config key resolved to, with secrets
+// redacted.
+func printConfig(w io.Writer) {
+	if path := viper.ConfigFileUsed(); path != "" {
+		fmt.Fprintf(w, "# config file: %s\n", path)
+	}
+	for _, key := range configKeys {
+		value := viper.Get(key.name)
+		switch {
+		case key.secret && viper.GetString(key.name) != "":
+			value = "<redacted>"
+		case value == nil:
+			value = ""
+		}
+		fmt.Fprintf(w, "%s: %v\n", key.name, value)
+	}
+}
+
+func loadConfig(args []string) (*Config, error) {
+	configFile, err := bindConfigSources(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+	} else {
+		viper.SetConfigName("discord-exporter")
+		viper.AddConfigPath(".")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		if configFile != "" {
+			return nil, fmt.Errorf("error reading config file %s: %w", configFile, err)
+		}
+		// 環境変数やフラグだけで設定することもできるので、既定のファイルはなくてもよい
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+	if err := mergeOverrideConfig(); err != nil {
+		return nil, err
+	}
+	return configFromViper()
+}
+
+// mergeOverrideConfig merges the file given by overrideConfig, if any, over
+// the config file read by viper, so that its settings win over the config
+// file's while flags and environment variables still win over both. Viper
+// only rereads the config file when it changes, so this is repeated after
+// every reload.
+func mergeOverrideConfig() error {
+	path := viper.GetString("overrideConfig")
+	if path == "" {
+		return nil
+	}
+	// 別のインスタンスで読むので、設定ファイルと形式が違ってもよい
+	override := viper.New()
+	override.SetConfigFile(path)
+	if err := override.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reading override config file %s: %w", path, err)
+	}
+	return viper.MergeConfigMap(override.AllSettings())
+}
+
+// configFromViper builds and validates the Config from the sources bound by
+// bindConfigSources. It is called again when the config file changes.
+func configFromViper() (*Config, error) {
+	var err error
+	config := &Config{
+		Token:     viper.GetString("token"),
+		ServerIDs: parseServerIDs(viper.GetString("serverID"), viper.GetString("serverIDs")),
+
+		SQLitePath:     viper.GetString("sqlitePath"),
+		PeerURL:        viper.GetString("peerURL"),
+		CountReactions: viper.GetBool("countReactions"),
+		CountEmoji:     viper.GetBool("countEmoji"),
+		CountMentions:  viper.GetBool("countMentions"),
+
+		CountOrphanedReplies: viper.GetBool("countOrphanedReplies"),
+		CountEdited:          viper.GetBool("countEdited"),
+		CountAttachments:     viper.GetBool("countAttachments"),
+		CountAuthorTypes:     viper.GetBool("countAuthorTypes"),
+		CountPinned:          viper.GetBool("countPinned"),
+		AdminToken:           viper.GetString("adminToken"),
+		MetricsUsername:      viper.GetString("metricsUsername"),
+		MetricsPassword:      viper.GetString("metricsPassword"),
+
+		EmitPerChannelMessages:    viper.GetBool("emitPerChannelMessages"),
+		EmitPerChannelAttachments: viper.GetBool("emitPerChannelAttachments"),
+
+		LastMessagePosition: viper.GetBool("lastMessagePosition"),
+		CollectOnScrape:     viper.GetBool("collectOnScrape"),
+		EnableOpenMetrics:   viper.GetBool("enableOpenMetrics"),
+		SkipStartupCheck:    viper.GetBool("skipStartupCheck"),
+		CountOnline:         viper.GetBool("countOnline"),
+		CountBans:           viper.GetBool("countBans"),
+		CountInvites:        viper.GetBool("countInvites"),
+		CountRoles:          viper.GetBool("countRoles"),
+		CountVoiceMembers:   viper.GetBool("countVoiceMembers"),
+		IncrementalCount:    viper.GetBool("incrementalCount"),
+		IncludeThreads:      viper.GetBool("includeThreads"),
+	}
+
+	if path := viper.GetString("tokenFile"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tokenFile: %w", err)
+		}
+		config.Token = strings.TrimSpace(string(data))
+	} else if token := os.Getenv(tokenEnv); token != "" {
+		config.Token = token
+	}
+
+	token, err := normalizeToken(config.Token)
+	if err != nil {
+		return nil, err
+	}
+	config.Token = token
+
+	if config.Token == "" {
+		return nil, fmt.Errorf("no Discord token provided")
+	}
+
+	patterns := viper.GetStringSlice("keywordPatterns")
+	if len(patterns) > maxKeywordPatterns {
+		return nil, fmt.Errorf("too many keywordPatterns: %d (max %d)", len(patterns), maxKeywordPatterns)
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyword pattern %q: %w", pattern, err)
+		}
+		config.KeywordPatterns = append(config.KeywordPatterns, re)
+	}
+
+	config.IncludedChannels = parseExcludedChannels(channelListEntries("includeChannels"))
+	config.ExcludedChannels = parseExcludedChannels(channelListEntries("excludeChannels"))
+	config.ExcludeCaseInsensitive = viper.GetBool("excludeCaseInsensitive")
+	if config.ExcludeCaseInsensitive {
+		config.ExcludedChannels = lowerChannelNames(config.ExcludedChannels)
+	}
+	config.ExcludedChannelIDs = parseExcludedChannels(channelListEntries("excludeChannelIDs"))
+	for _, pattern := range viper.GetStringSlice("excludeChannelsRegex") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excludeChannelsRegex pattern %q: %w", pattern, err)
+		}
+		config.ExcludedChannelPatterns = append(config.ExcludedChannelPatterns, re)
+	}
+
+	config.MetricsPort = viper.GetString("metricsPort")
+	if config.MetricsPort == "" {
+		config.MetricsPort = defaultMetricsPort
+	}
+	if err := validateListenAddress(config.MetricsPort); err != nil {
+		return nil, fmt.Errorf("invalid metricsPort %q: %w", config.MetricsPort, err)
+	}
+
+	if (config.MetricsUsername == "") != (config.MetricsPassword == "") {
+		return nil, fmt.Errorf("metricsUsername and metricsPassword must be set together")
+	}
+
+	config.TLSCertFile = viper.GetString("tlsCertFile")
+	config.TLSKeyFile = viper.GetString("tlsKeyFile")
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	for _, path := range []string{config.TLSCertFile, config.TLSKeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("invalid TLS file: %w", err)
+		}
+	}
+
+	config.MetricNamespace = viper.GetString("metricNamespace")
+	if config.MetricNamespace != "" && !metricNamespacePattern.MatchString(config.MetricNamespace) {
+		return nil, fmt.Errorf("invalid metricNamespace %q: must consist of letters, digits and underscores and not start with a digit", config.MetricNamespace)
+	}
+	if config.ConstantLabels, err = parseConstantLabels(); err != nil {
+		return nil, err
+	}
+
+	config.PathPrefix = strings.TrimRight(viper.GetString("pathPrefix"), "/")
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		config.PathPrefix = "/" + config.PathPrefix
+	}
+
+	if config.MessageCountBuckets, err = parseBuckets("messageCountBuckets"); err != nil {
+		return nil, err
+	}
+	config.MessageAgeHistogram = viper.GetBool("messageAgeHistogram")
+	if config.MessageAgeBuckets, err = parseBuckets("messageAgeBuckets"); err != nil {
+		return nil, err
+	}
+	// 累計に足していくと古いメッセージの経過時間が更新されない
+	if config.MessageAgeHistogram && viper.GetBool("incrementalCount") {
+		return nil, fmt.Errorf("messageAgeHistogram can't be combined with incrementalCount")
+	}
+
+	config.MemberFlags = viper.GetStringSlice("memberFlags")
+	if len(config.MemberFlags) > maxMemberFlags {
+		return nil, fmt.Errorf("too many memberFlags: %d (max %d)", len(config.MemberFlags), maxMemberFlags)
+	}
+	for _, name := range config.MemberFlags {
+		if _, ok := memberFlags[name]; !ok {
+			return nil, fmt.Errorf("unknown member flag %q", name)
+		}
+	}
+
+	config.TopTalkers = viper.GetInt("topTalkers")
+	if config.TopTalkers < 0 || config.TopTalkers > maxTopTalkers {
+		return nil, fmt.Errorf("invalid topTalkers %d: must be between 0 and %d", config.TopTalkers, maxTopTalkers)
+	}
+
+	config.NormalizeChannelLabels = viper.GetBool("normalizeChannelLabels")
+
+	config.MessagesPerDay = viper.GetInt("messagesPerDay")
+	if config.MessagesPerDay < 0 || config.MessagesPerDay > maxMessagesPerDay {
+		return nil, fmt.Errorf("invalid messagesPerDay %d: must be between 0 and %d", config.MessagesPerDay, maxMessagesPerDay)
+	}
+	if config.MessagesPerDayLocation, err = time.LoadLocation(viper.GetString("messagesPerDayTimezone")); err != nil {
+		return nil, fmt.Errorf("invalid messagesPerDayTimezone %q: %w", viper.GetString("messagesPerDayTimezone"), err)
+	}
+
+	config.TopReactionEmoji = viper.GetInt("topReactionEmoji")
+	if config.TopReactionEmoji < 0 || config.TopReactionEmoji > maxTopReactionEmoji {
+		return nil, fmt.Errorf("invalid topReactionEmoji %d: must be between 0 and %d", config.TopReactionEmoji, maxTopReactionEmoji)
+	}
+	if config.TopReactionEmoji > 0 && !config.CountReactions {
+		return nil, fmt.Errorf("topReactionEmoji needs countReactions")
+	}
+	config.CustomEmojiOnly = viper.GetBool("customEmojiOnly")
+
+	config.CountRoleID = viper.GetString("countRoleID")
+
+	config.MessagePageSize = viper.GetInt("messagePageSize")
+	if config.MessagePageSize < 1 || config.MessagePageSize > maxMessagesPerRequest {
+		clamped := min(max(config.MessagePageSize, 1), maxMessagesPerRequest)
+		slog.Warn("messagePageSize is out of range, clamping it", "messagePageSize", config.MessagePageSize, "min", 1, "max", maxMessagesPerRequest, "using", clamped)
+		config.MessagePageSize = clamped
+	}
+
+	config.MaxMessagePagesPerChannel = viper.GetInt("maxMessagePagesPerChannel")
+	if config.MaxMessagePagesPerChannel < 0 {
+		return nil, fmt.Errorf("invalid maxMessagePagesPerChannel %d: must not be negative", config.MaxMessagePagesPerChannel)
+	}
+	// 打ち切った件数を累計の起点にすると、その後もずっと少ないままになる
+	if config.MaxMessagePagesPerChannel > 0 && viper.GetBool("incrementalCount") {
+		return nil, fmt.Errorf("maxMessagePagesPerChannel can't be combined with incrementalCount")
+	}
+
+	config.ActivityTopN = viper.GetInt("activityTopN")
+	if config.ActivityTopN < 0 || config.ActivityTopN > maxActivityTopN {
+		return nil, fmt.Errorf("invalid activityTopN %d: must be between 0 and %d", config.ActivityTopN, maxActivityTopN)
+	}
+
+	groups := viper.GetStringSlice("metrics")
+	config.MetricGroups = make(map[string]bool, len(groups))
+	for _, group := range groups {
+		group = strings.TrimSpace(group)
+		if !slices.Contains(knownMetricGroups, group) {
+			return nil, fmt.Errorf("unknown metric group %q, must be one of %s", group, strings.Join(knownMetricGroups, ", "))
+		}
+		config.MetricGroups[group] = true
+	}
+
+	config.MaxConcurrentChannels = viper.GetInt("maxConcurrentChannels")
+	if config.MaxConcurrentChannels < 1 || config.MaxConcurrentChannels > maxWorkerPoolSize {
+		return nil, fmt.Errorf("invalid maxConcurrentChannels %d: must be between 1 and %d", config.MaxConcurrentChannels, maxWorkerPoolSize)
+	}
+
+	config.LogFormat = viper.GetString("logFormat")
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid logFormat %q: must be text or json", config.LogFormat)
+	}
+	if config.LogLevel, err = parseLogLevel(viper.GetString("logLevel")); err != nil {
+		return nil, err
+	}
+
+	config.Mode = viper.GetString("mode")
+	switch config.Mode {
+	case modeServe:
+	case modePush:
+		config.PushgatewayURL = viper.GetString("pushgatewayURL")
+		if config.PushgatewayURL == "" {
+			return nil, fmt.Errorf("mode push needs pushgatewayURL")
+		}
+		if _, err := url.Parse(config.PushgatewayURL); err != nil {
+			return nil, fmt.Errorf("invalid pushgatewayURL %q: %w", config.PushgatewayURL, err)
+		}
+		config.PushJob = viper.GetString("pushJob")
+		if config.PushJob == "" {
+			return nil, fmt.Errorf("invalid pushJob: must not be empty")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode %q: must be serve or push", config.Mode)
+	}
+
+	config.OnChannelError = viper.GetString("onChannelError")
+	if config.OnChannelError != onChannelErrorKeep && config.OnChannelError != onChannelErrorClear {
+		return nil, fmt.Errorf("invalid onChannelError %q: must be keep or clear", config.OnChannelError)
+	}
+
+	config.MaxRetries = viper.GetInt("maxRetries")
+	if config.MaxRetries < 0 {
+		return nil, fmt.Errorf("invalid maxRetries %d: must not be negative", config.MaxRetries)
+	}
+
+	config.StaleAfterIntervals = viper.GetFloat64("staleAfterIntervals")
+	if config.StaleAfterIntervals <= 0 {
+		return nil, fmt.Errorf("invalid staleAfterIntervals %q: must be a positive number", viper.GetString("staleAfterIntervals"))
+	}
+
+	if config.UpdateInterval, err = parseDuration("updateInterval"); err != nil {
+		return nil, err
+	}
+	if err := parseGuilds(config); err != nil {
+		return nil, err
+	}
+	if viper.GetString("cacheTTL") != "" {
+		if config.CacheTTL, err = parseDuration("cacheTTL"); err != nil {
+			return nil, err
+		}
+		if !config.CollectOnScrape {
+			return nil, fmt.Errorf("cacheTTL needs collectOnScrape")
+		}
+	}
+	if viper.GetString("cycleTimeout") != "" {
+		if config.CycleTimeout, err = parseDuration("cycleTimeout"); err != nil {
+			return nil, err
+		}
+	}
+	if viper.GetString("scrapeJitter") != "" {
+		if config.ScrapeJitter, err = parseDuration("scrapeJitter"); err != nil {
+			return nil, err
+		}
+	}
+	if config.ReadTimeout, err = parseDuration("readTimeout"); err != nil {
+		return nil, err
+	}
+	if config.WriteTimeout, err = parseDuration("writeTimeout"); err != nil {
+		return nil, err
+	}
+	if config.IdleTimeout, err = parseDuration("idleTimeout"); err != nil {
+		return nil, err
+	}
+	if config.HTTPTimeout, err = parseDuration("httpTimeout"); err != nil {
+		return nil, err
+	}
+	if proxy := viper.GetString("httpProxy"); proxy != "" {
+		config.HTTPProxy, err = url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid httpProxy %q: %w", proxy, err)
+		}
+		switch config.HTTPProxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid httpProxy %q: scheme must be http, https or socks5", proxy)
+		}
+		if config.HTTPProxy.Host == "" {
+			return nil, fmt.Errorf("invalid httpProxy %q: missing host", proxy)
+		}
+	}
+	if viper.GetString("messageLookback") != "" {
+		if config.MessageLookback, err = parseDuration("messageLookback"); err != nil {
+			return nil, err
+		}
+		// 古いメッセージが期間外になっても引けないので、累計とは組み合わせられない
+		if config.IncrementalCount {
+			return nil, fmt.Errorf("messageLookback can't be combined with incrementalCount")
+		}
+	}
+	// 有効なグループが決まってから、ラベルの衝突を実際に登録して確かめる
+	if err := checkConstantLabels(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// normalizeToken strips a "Bot " prefix (in any case) so that the token can be
+// pasted either way, and rejects OAuth bearer tokens.
+func normalizeToken(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if len(token) >= len("Bearer ") && strings.EqualFold(token[:len("Bearer ")], "Bearer ") {
+		return "", fmt.Errorf("OAuth bearer tokens are not supported, configure a bot token instead")
+	}
+	if len(token) >= len("Bot ") && strings.EqualFold(token[:len("Bot ")], "Bot ") {
+		token = strings.TrimSpace(token[len("Bot "):])
+	}
+	return token, nil
+}
+
+// parseServerIDs merges the single serverID with the comma-separated serverIDs,
+// keeping their order and dropping duplicates and empty entries.
+func parseServerIDs(serverID, list string) []string {
+	var serverIDs []string
+	for _, id := range append([]string{serverID}, strings.Split(list, ",")...) {
+		if id = strings.TrimSpace(id); id != "" && !slices.Contains(serverIDs, id) {
+			serverIDs = append(serverIDs, id)
+		}
+	}
+	return serverIDs
+}
+
+// channelListEntries returns the entries of a channel list key. A YAML
+// sequence is taken as is, so that its entries may contain commas, while a
+// string, as given by a flag or environment variable, is split on commas.
+func channelListEntries(key string) []string {
+	switch viper.Get(key).(type) {
+	case []interface{}, []string:
+		return viper.GetStringSlice(key)
+	default:
+		return strings.Split(viper.GetString(key), ",")
+	}
+}
+
+// parseExcludedChannels turns channel names or IDs, excluded or included, into
+// a set, ignoring surrounding whitespace and empty entries.
+func parseExcludedChannels(entries []string) map[string]struct{} {
+	excluded := make(map[string]struct{})
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			excluded[entry] = struct{}{}
+		}
+	}
+	return excluded
+}
+
+// lowerChannelNames returns the set of the lowercased channel names, for
+// excludeCaseInsensitive.
+func lowerChannelNames(names map[string]struct{}) map[string]struct{} {
+	lowered := make(map[string]struct{}, len(names))
+	for name := range names {
+		lowered[strings.ToLower(name)] = struct{}{}
+	}
+	return lowered
+}
+
+// guildBlockKeys are the keys of a guilds block, lowercased as viper reads
+// them.
+var guildBlockKeys = []string{"serverid", "includechannels", "excludechannels", "interval"}
+
+// parseGuilds reads the guilds blocks into config.Guilds and adds their
+// servers to config.ServerIDs. A block needs a serverID that no other block
+// has, and its interval must not be shorter than updateInterval, since
+// messages are only counted in collection cycles. It is called after
+// excludeCaseInsensitive and updateInterval have been read.
+func parseGuilds(config *Config) error {
+	value := viper.Get("guilds")
+	if value == nil {
+		return nil
+	}
+	// 環境変数では文字列になってしまう
+	blocks, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("invalid guilds: must be a list of blocks, which can only be set in the config file")
+	}
+	config.Guilds = make(map[string]*GuildConfig, len(blocks))
+	for i, block := range blocks {
+		settings, ok := block.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid guilds entry %d: must be a block of settings", i+1)
+		}
+		lowered := make(map[string]interface{}, len(settings))
+		for key, value := range settings {
+			if !slices.Contains(guildBlockKeys, strings.ToLower(key)) {
+				return fmt.Errorf("invalid guilds entry %d: unknown key %q, must be one of serverID, includeChannels, excludeChannels and interval", i+1, key)
+			}
+			lowered[strings.ToLower(key)] = value
+		}
+
+		guild := &GuildConfig{}
+		if serverID, ok := lowered["serverid"]; ok && serverID != nil {
+			guild.ServerID = strings.TrimSpace(fmt.Sprint(serverID))
+		}
+		if guild.ServerID == "" {
+			return fmt.Errorf("invalid guilds entry %d: missing serverID", i+1)
+		}
+		if _, ok := config.Guilds[guild.ServerID]; ok {
+			return fmt.Errorf("invalid guilds entry %d: server %s already has a block", i+1, guild.ServerID)
+		}
+		if entries, ok := lowered["includechannels"]; ok {
+			list, err := blockChannelEntries(entries)
+			if err != nil {
+				return fmt.Errorf("invalid includeChannels of server %s: %w", guild.ServerID, err)
+			}
+			guild.IncludedChannels = parseExcludedChannels(list)
+		}
+		if entries, ok := lowered["excludechannels"]; ok {
+			list, err := blockChannelEntries(entries)
+			if err != nil {
+				return fmt.Errorf("invalid excludeChannels of server %s: %w", guild.ServerID, err)
+			}
+			guild.ExcludedChannels = parseExcludedChannels(list)
+			if config.ExcludeCaseInsensitive {
+				guild.ExcludedChannels = lowerChannelNames(guild.ExcludedChannels)
+			}
+		}
+		if interval, ok := lowered["interval"]; ok {
+			d, err := time.ParseDuration(fmt.Sprint(interval))
+			if err != nil {
+				return fmt.Errorf("invalid interval of server %s: %w", guild.ServerID, err)
+			}
+			if d < config.UpdateInterval {
+				return fmt.Errorf("invalid interval %s of server %s: must not be shorter than updateInterval %s", d, guild.ServerID, config.UpdateInterval)
+			}
+			guild.Interval = d
+			// 数えなかったギルドの分を前回の値で埋められない
+			if config.MessageAgeHistogram {
+				return fmt.Errorf("the interval of guilds can't be combined with messageAgeHistogram")
+			}
+		}
+
+		config.Guilds[guild.ServerID] = guild
+		if !slices.Contains(config.ServerIDs, guild.ServerID) {
+			config.ServerIDs = append(config.ServerIDs, guild.ServerID)
+		}
+	}
+	return nil
+}
+
+// blockChannelEntries returns the entries of a channel list of a guilds block,
+// which like channelListEntries is either a YAML sequence taken as is or a
+// comma-separated string.
+func blockChannelEntries(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Split(value, ","), nil
+	case []interface{}:
+		entries := make([]string, 0, len(value))
+		for _, entry := range value {
+			// 数字だけの ID は YAML では数値になる
+			entries = append(entries, fmt.Sprint(entry))
+		}
+		return entries, nil
+	default:
+		return nil, fmt.Errorf("must be a list or a comma-separated string")
+	}
+}
+
+// validateListenAddress accepts ":PORT" and "host:port".
+func validateListenAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port must be a number between 1 and 65535")
+	}
+	return nil
+}
+
+// parseBuckets reads key as a list of histogram bucket upper bounds, which
+// must be in increasing order.
+func parseBuckets(key string) ([]float64, error) {
+	var bounds []float64
+	for _, bucket := range viper.GetStringSlice(key) {
+		bound, err := strconv.ParseFloat(bucket, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, bucket, err)
+		}
+		bounds = append(bounds, bound)
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		return nil, fmt.Errorf("%s must be in increasing order", key)
+	}
+	return bounds, nil
+}
+
+// parseConstantLabels reads constantLabels, a map in the config file and a
+// comma-separated list of name=value pairs in the environment variable.
+func parseConstantLabels() (map[string]string, error) {
+	labels := viper.GetStringMapString("constantLabels")
+	if value, ok := viper.Get("constantLabels").(string); ok {
+		labels = make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			name, labelValue, found := strings.Cut(pair, "=")
+			if !found {
+				return nil, fmt.Errorf("invalid constantLabels entry %q: must be name=value", pair)
+			}
+			labels[name] = labelValue
+		}
+	}
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid constantLabels name %q", name)
+		}
+	}
+	return labels, nil
+}
+
+// checkConstantLabels rejects the constantLabels names that a metric of the
+// enabled groups already has as a label, like guild or channel, which would
+// make registering that metric fail.
+func checkConstantLabels(config *Config) error {
+	names := make([]string, 0, len(config.ConstantLabels))
+	for name := range config.ConstantLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		probe := *config
+		probe.ConstantLabels = map[string]string{name: "probe"}
+		if err := registerMetrics(prometheus.NewRegistry(), &probe); err != nil {
+			return fmt.Errorf("invalid constantLabels name %q: it is already a label of the exporter's metrics", name)
+		}
+	}
+	return nil
+}
+
+// parseDuration reads key as a Go duration string. Zero and negative durations
+// are rejected.
+func parseDuration(key string) (time.Duration, error) {
+	value := viper.GetString(key)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", key, value)
+	}
+	return d, nil
+}
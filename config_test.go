@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig resolves the config from the defaults and settings, as if
+// they were read from a config file.
+func loadTestConfig(t *testing.T, settings map[string]any) (*Config, error) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	if _, err := bindConfigSources(nil); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("token", "test-token")
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	return configFromViper()
+}
+
+func TestConfigGuilds(t *testing.T) {
+	cfg, err := loadTestConfig(t, map[string]any{
+		"serverID":               "g1",
+		"excludeCaseInsensitive": true,
+		"guilds": []any{
+			map[string]any{"serverID": "g2", "excludeChannels": []any{"Logs", 1234}, "interval": "30m"},
+			map[string]any{"serverID": 3456, "includeChannels": "general, news"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.ServerIDs, ","); got != "g1,g2,3456" {
+		t.Errorf("ServerIDs = %s, want g1,g2,3456", got)
+	}
+	g2 := cfg.Guilds["g2"]
+	if g2 == nil || g2.Interval != 30*time.Minute || g2.IncludedChannels != nil {
+		t.Fatalf("guild g2 = %+v, want a 30m interval and the global includeChannels", g2)
+	}
+	for _, name := range []string{"logs", "1234"} {
+		if _, ok := g2.ExcludedChannels[name]; !ok {
+			t.Errorf("guild g2 doesn't exclude %q: %v", name, g2.ExcludedChannels)
+		}
+	}
+	g3 := cfg.Guilds["3456"]
+	if g3 == nil || len(g3.IncludedChannels) != 2 || g3.ExcludedChannels != nil || g3.Interval != 0 {
+		t.Errorf("guild 3456 = %+v, want general and news included", g3)
+	}
+}
+
+func TestConfigGuildsInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		guilds any
+		want   string
+	}{
+		"string":           {"g1", "must be a list of blocks"},
+		"missing serverID": {[]any{map[string]any{"interval": "1h"}}, "missing serverID"},
+		"duplicate":        {[]any{map[string]any{"serverID": "g1"}, map[string]any{"serverID": "g1"}}, "already has a block"},
+		"unknown key":      {[]any{map[string]any{"serverID": "g1", "exclude": "logs"}}, `unknown key "exclude"`},
+		"short interval":   {[]any{map[string]any{"serverID": "g1", "interval": "10s"}}, "must not be shorter than updateInterval"},
+		"bad interval":     {[]any{map[string]any{"serverID": "g1", "interval": "soon"}}, "invalid interval"},
+		"bad channels":     {[]any{map[string]any{"serverID": "g1", "includeChannels": map[string]any{"a": "b"}}}, "invalid includeChannels"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadTestConfig(t, map[string]any{"guilds": test.guilds})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeToken(t *testing.T) {
+	for _, test := range []struct {
+		token, want string
+	}{
+		{"abc.def", "abc.def"},
+		{"Bot abc.def", "abc.def"},
+		{"bot abc.def", "abc.def"},
+		{"  Bot   abc.def \n", "abc.def"},
+	} {
+		got, err := normalizeToken(test.token)
+		if err != nil || got != test.want {
+			t.Errorf("normalizeToken(%q) = %q, %v, want %q", test.token, got, err, test.want)
+		}
+	}
+	if _, err := normalizeToken("Bearer abc.def"); err == nil {
+		t.Error("normalizeToken accepted a bearer token")
+	}
+}
+
+// writeConfigFile writes a config file into a temporary directory and returns
+// its path.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	path := writeConfigFile(t, "config.yaml", `
+token: file-token
+serverID: "1"
+countEmoji: true
+updateInterval: 1m
+metricsPort: ":1000"
+`)
+	t.Setenv(envPrefix+"_UPDATEINTERVAL", "2m")
+	t.Setenv(envPrefix+"_METRICSPORT", ":2000")
+
+	cfg, err := loadConfig([]string{"--config", path, "--metricsPort", ":3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.CountEmoji {
+		t.Error("countEmoji from the file was not applied")
+	}
+	if cfg.UpdateInterval != 2*time.Minute {
+		t.Errorf("updateInterval = %s, want the environment's 2m over the file's", cfg.UpdateInterval)
+	}
+	if cfg.MetricsPort != ":3000" {
+		t.Errorf("metricsPort = %s, want the flag's :3000 over the environment's", cfg.MetricsPort)
+	}
+	if cfg.MessagePageSize != maxMessagesPerRequest {
+		t.Errorf("messagePageSize = %d, want the default %d", cfg.MessagePageSize, maxMessagesPerRequest)
+	}
+}
+
+func TestConfigExcludeChannelsRegex(t *testing.T) {
+	cfg, err := loadTestConfig(t, map[string]any{"excludeChannelsRegex": []any{"^log-", "-archive$"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t).ExcludedChannelPatterns = cfg.ExcludedChannelPatterns
+	for name, want := range map[string]bool{
+		"log-bot":     true,
+		"old-archive": true,
+		"general":     false,
+		"blog-posts":  false,
+	} {
+		if got := isExcludedChannel(&discordgo.Channel{GuildID: "g1", Name: name}); got != want {
+			t.Errorf("isExcludedChannel(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	_, err = loadTestConfig(t, map[string]any{"excludeChannelsRegex": []any{"log-("}})
+	if err == nil || !strings.Contains(err.Error(), `invalid excludeChannelsRegex pattern "log-("`) {
+		t.Errorf("err = %v, want the invalid pattern rejected", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	t.Cleanup(func() { checkConfigOnly = false })
+	path := writeConfigFile(t, "config.yaml", `
+token: file-token
+serverID: "1"
+updateInterval: 5m
+`)
+	if _, err := loadConfig([]string{"--config", path, "--check-config"}); err != nil {
+		t.Fatal(err)
+	}
+	if !checkConfigOnly {
+		t.Fatal("--check-config was not set")
+	}
+	var out strings.Builder
+	printConfig(&out)
+	for _, want := range []string{"# config file: " + path, "serverID: 1\n", "updateInterval: 5m\n", "token: <redacted>\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("printConfig output is missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "file-token") {
+		t.Error("printConfig printed the token")
+	}
+
+	viper.Reset()
+	path = writeConfigFile(t, "invalid.yaml", `
+token: file-token
+serverID: "1"
+updateInterval: soon
+`)
+	if _, err := loadConfig([]string{"--config", path, "--check-config"}); err == nil || !strings.Contains(err.Error(), "updateInterval") {
+		t.Errorf("err = %v, want the invalid updateInterval rejected", err)
+	}
+}
+
+func TestConfigConstantLabels(t *testing.T) {
+	cfg, err := loadTestConfig(t, map[string]any{"constantLabels": "env=prod, region=eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.ConstantLabels) != 2 || cfg.ConstantLabels["env"] != "prod" || cfg.ConstantLabels["region"] != "eu" {
+		t.Errorf("ConstantLabels = %v, want env=prod and region=eu", cfg.ConstantLabels)
+	}
+
+	// メトリクスのラベルと同じ名前は登録できないので起動前に弾く
+	for _, name := range []string{"guild", "channel"} {
+		_, err := loadTestConfig(t, map[string]any{"constantLabels": map[string]any{name: "x"}})
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("invalid constantLabels name %q", name)) {
+			t.Errorf("constantLabels %s: err = %v, want the name rejected", name, err)
+		}
+	}
+}
+
+func TestConfigExcludeChannelsForms(t *testing.T) {
+	for name, test := range map[string]struct {
+		value any
+		want  []string
+	}{
+		"string": {" general, random ,,", []string{"general", "random"}},
+		"list":   {[]any{"general", " random "}, []string{"general", "random"}},
+		// YAML のリストの要素はカンマを含んでいても分けない
+		"list of names": {[]any{"news, updates", "general"}, []string{"general", "news, updates"}},
+		"empty":         {"", nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, map[string]any{"excludeChannels": test.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := sortedKeys(cfg.ExcludedChannels)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("ExcludedChannels = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigOverrideFile(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	base := writeConfigFile(t, "discord-exporter.yaml", `
+token: file-token
+serverID: "1"
+updateInterval: 1m
+excludeChannels: [logs]
+`)
+	override := writeConfigFile(t, "prod.yaml", `
+excludeChannels: [random, staff]
+updateInterval: 10m
+`)
+
+	cfg, err := loadConfig([]string{"--config", base, "--overrideConfig", override})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token != "file-token" || len(cfg.ServerIDs) != 1 || cfg.ServerIDs[0] != "1" {
+		t.Errorf("token and serverID = %s %v, want those of the base file", cfg.Token, cfg.ServerIDs)
+	}
+	// 上書きファイルの値が勝つ
+	if cfg.UpdateInterval != 10*time.Minute {
+		t.Errorf("updateInterval = %s, want the override's 10m", cfg.UpdateInterval)
+	}
+	if got := strings.Join(sortedKeys(cfg.ExcludedChannels), ","); got != "random,staff" {
+		t.Errorf("excludeChannels = %s, want the override's random,staff", got)
+	}
+}
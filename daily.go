@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+	// Alpine イメージにはタイムゾーンのデータがない
+	_ "time/tzdata"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxMessagesPerDay bounds messagesPerDay, since every day adds one
+// discord_messages_per_day series per channel.
+const maxMessagesPerDay = 31
+
+const dayLayout = "2006-01-02"
+
+var messagesPerDayGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_messages_per_day",
+		Help: "Number of messages per channel posted on each of the last messagesPerDay days",
+	},
+	[]string{"channel", "date"},
+)
+
+// messageDays returns the dates of the last messagesPerDay days up to today in
+// messagesPerDayTimezone, oldest first.
+func messageDays(now time.Time) []string {
+	today := now.In(config.MessagesPerDayLocation)
+	days := make([]string, config.MessagesPerDay)
+	for i := range days {
+		days[i] = today.AddDate(0, 0, i-len(days)+1).Format(dayLayout)
+	}
+	return days
+}
+
+// messageDay returns the date a message was posted on in
+// messagesPerDayTimezone.
+func messageDay(message *discordgo.Message) string {
+	return message.Timestamp.In(config.MessagesPerDayLocation).Format(dayLayout)
+}
+
+// updateMessagesPerDay replaces the channel's discord_messages_per_day series
+// with one per day of the window, zero for days without messages.
+func updateMessagesPerDay(channel *discordgo.Channel, counts map[string]int, now time.Time) {
+	messagesPerDayGauge.DeletePartialMatch(prometheus.Labels{"channel": channel.Name})
+	for _, day := range messageDays(now) {
+		messagesPerDayGauge.WithLabelValues(channel.Name, day).Set(float64(counts[day]))
+	}
+}
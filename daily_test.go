@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateMessageCountMessagesPerDay(t *testing.T) {
+	cfg := setupTest(t)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MessagesPerDay = 3
+	cfg.MessagesPerDayLocation = tokyo
+	messagesPerDayGauge.Reset()
+	// 東京の日付で 3 日間にまたがるメッセージと、期間より前のもの
+	today := time.Now().In(tokyo)
+	noon := time.Date(today.Year(), today.Month(), today.Day(), 12, 0, 0, 0, tokyo)
+	if noon.After(time.Now()) {
+		noon = noon.Add(-12 * time.Hour)
+	}
+	var messages []*discordgo.Message
+	for _, at := range []time.Time{
+		noon,
+		noon.AddDate(0, 0, -1),
+		noon.AddDate(0, 0, -1).Add(-time.Minute),
+		noon.AddDate(0, 0, -2),
+		noon.AddDate(0, 0, -5),
+	} {
+		messages = append(messages, &discordgo.Message{ID: fakeSnowflake(at), Timestamp: at})
+	}
+	fake := newFakeDiscord()
+	fake.channels["g1"] = []*discordgo.Channel{fakeTextChannel("g1", "101", "general", messages)}
+	fake.messages["101"] = messages
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	for daysAgo, want := range []float64{1, 2, 1} {
+		date := today.AddDate(0, 0, -daysAgo).Format(dayLayout)
+		wantSeries(t, messagesPerDayGauge, prometheus.Labels{"channel": "general", "date": date}, want)
+	}
+	wantNoSeries(t, messagesPerDayGauge, prometheus.Labels{"channel": "general", "date": today.AddDate(0, 0, -5).Format(dayLayout)})
+}
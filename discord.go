@@ -0,0 +1,34 @@
+package main
+
+import "github.com/bwmarrin/discordgo"
+
+// discordClient is the part of the Discord REST API the collection path uses.
+// *discordgo.Session satisfies it; the gateway state used for presences and
+// voice states is read from the session with sessionState.
+type discordClient interface {
+	User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error)
+	UserGuilds(limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.UserGuild, error)
+	Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error)
+	GuildWithCounts(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error)
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+	GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	GuildBans(guildID string, limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.GuildBan, error)
+	GuildInvites(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Invite, error)
+	GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error)
+	GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error)
+	GuildThreadsActive(guildID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	ChannelMessagesPinned(channelID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error)
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error)
+}
+
+var _ discordClient = (*discordgo.Session)(nil)
+
+// sessionState returns the gateway state of the client if it is a
+// *discordgo.Session, and an empty state otherwise, e.g. for a fake client in
+// tests, so that the gateway metrics find nothing delivered.
+func sessionState(client discordClient) *discordgo.State {
+	if session, ok := client.(*discordgo.Session); ok && session.State != nil {
+		return session.State
+	}
+	return discordgo.NewState()
+}
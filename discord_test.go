@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeDiscord is a discordClient serving canned guilds, channels, members and
+// messages from memory. Messages are kept per channel and paged by ID like
+// Discord does, so pagination is exercised for real. Methods without data
+// return a 404 like Discord would; fail can inject errors, delays or panics.
+type fakeDiscord struct {
+	mu    sync.Mutex
+	calls map[string]int
+
+	guilds   map[string]*discordgo.Guild
+	channels map[string][]*discordgo.Channel
+	members  map[string][]*discordgo.Member
+	roles    map[string][]*discordgo.Role
+	bans     map[string][]*discordgo.GuildBan
+	invites  map[string][]*discordgo.Invite
+	threads  map[string][]*discordgo.Channel
+	messages map[string][]*discordgo.Message
+	pinned   map[string][]*discordgo.Message
+	bot      *discordgo.User
+	joinedAt map[string]time.Time
+
+	// fail is called first by every method with the method name, the guild or
+	// channel ID it was called for and the request context. An error it
+	// returns is returned by the method.
+	fail func(ctx context.Context, method, id string) error
+}
+
+var _ discordClient = (*fakeDiscord)(nil)
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{
+		calls:    make(map[string]int),
+		guilds:   make(map[string]*discordgo.Guild),
+		channels: make(map[string][]*discordgo.Channel),
+		members:  make(map[string][]*discordgo.Member),
+		roles:    make(map[string][]*discordgo.Role),
+		bans:     make(map[string][]*discordgo.GuildBan),
+		invites:  make(map[string][]*discordgo.Invite),
+		threads:  make(map[string][]*discordgo.Channel),
+		messages: make(map[string][]*discordgo.Message),
+		pinned:   make(map[string][]*discordgo.Message),
+		joinedAt: make(map[string]time.Time),
+	}
+}
+
+// callCount returns how often method was called.
+func (f *fakeDiscord) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// totalCalls returns the number of calls of all methods.
+func (f *fakeDiscord) totalCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	total := 0
+	for _, n := range f.calls {
+		total += n
+	}
+	return total
+}
+
+func (f *fakeDiscord) call(method, id string, options []discordgo.RequestOption) error {
+	f.mu.Lock()
+	f.calls[method]++
+	fail := f.fail
+	f.mu.Unlock()
+	if fail != nil {
+		return fail(requestContext(options), method, id)
+	}
+	return nil
+}
+
+// requestContext returns the context set with discordgo.WithContext.
+func requestContext(options []discordgo.RequestOption) context.Context {
+	cfg := &discordgo.RequestConfig{Request: httptest.NewRequest(http.MethodGet, "/", nil)}
+	for _, option := range options {
+		option(cfg)
+	}
+	return cfg.Request.Context()
+}
+
+// restError returns the error discordgo returns for a response with status.
+func restError(status int) error {
+	return &discordgo.RESTError{Response: &http.Response{StatusCode: status, Status: http.StatusText(status)}}
+}
+
+func (f *fakeDiscord) User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	if err := f.call("User", userID, options); err != nil {
+		return nil, err
+	}
+	if f.bot == nil {
+		return nil, restError(http.StatusNotFound)
+	}
+	return f.bot, nil
+}
+
+func (f *fakeDiscord) UserGuilds(limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.UserGuild, error) {
+	if err := f.call("UserGuilds", "", options); err != nil {
+		return nil, err
+	}
+	var guilds []*discordgo.UserGuild
+	for _, id := range sortedKeys(f.guilds) {
+		guilds = append(guilds, &discordgo.UserGuild{ID: id, Name: f.guilds[id].Name})
+	}
+	return guilds[:min(limit, len(guilds))], nil
+}
+
+func (f *fakeDiscord) Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	if err := f.call("Guild", guildID, options); err != nil {
+		return nil, err
+	}
+	guild, ok := f.guilds[guildID]
+	if !ok {
+		return nil, restError(http.StatusNotFound)
+	}
+	return guild, nil
+}
+
+func (f *fakeDiscord) GuildWithCounts(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	if err := f.call("GuildWithCounts", guildID, options); err != nil {
+		return nil, err
+	}
+	guild, ok := f.guilds[guildID]
+	if !ok {
+		return nil, restError(http.StatusNotFound)
+	}
+	return guild, nil
+}
+
+func (f *fakeDiscord) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	if err := f.call("GuildMember", guildID, options); err != nil {
+		return nil, err
+	}
+	joinedAt, ok := f.joinedAt[guildID]
+	if !ok {
+		return nil, restError(http.StatusNotFound)
+	}
+	return &discordgo.Member{GuildID: guildID, User: &discordgo.User{ID: userID}, JoinedAt: joinedAt}, nil
+}
+
+// GuildMembers returns up to limit members with a user ID after after, in
+// user ID order.
+func (f *fakeDiscord) GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	if err := f.call("GuildMembers", guildID, options); err != nil {
+		return nil, err
+	}
+	members := append([]*discordgo.Member(nil), f.members[guildID]...)
+	sort.Slice(members, func(i, j int) bool {
+		return newerSnowflake(members[j].User.ID, members[i].User.ID)
+	})
+	var page []*discordgo.Member
+	for _, member := range members {
+		if newerSnowflake(member.User.ID, after) && len(page) < limit {
+			page = append(page, member)
+		}
+	}
+	return page, nil
+}
+
+func (f *fakeDiscord) GuildBans(guildID string, limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.GuildBan, error) {
+	if err := f.call("GuildBans", guildID, options); err != nil {
+		return nil, err
+	}
+	var page []*discordgo.GuildBan
+	for _, ban := range f.bans[guildID] {
+		if newerSnowflake(ban.User.ID, afterID) && len(page) < limit {
+			page = append(page, ban)
+		}
+	}
+	return page, nil
+}
+
+func (f *fakeDiscord) GuildInvites(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Invite, error) {
+	if err := f.call("GuildInvites", guildID, options); err != nil {
+		return nil, err
+	}
+	return f.invites[guildID], nil
+}
+
+func (f *fakeDiscord) GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	if err := f.call("GuildRoles", guildID, options); err != nil {
+		return nil, err
+	}
+	return f.roles[guildID], nil
+}
+
+func (f *fakeDiscord) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	if err := f.call("GuildChannels", guildID, options); err != nil {
+		return nil, err
+	}
+	channels, ok := f.channels[guildID]
+	if !ok {
+		return nil, restError(http.StatusNotFound)
+	}
+	return channels, nil
+}
+
+func (f *fakeDiscord) GuildThreadsActive(guildID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	if err := f.call("GuildThreadsActive", guildID, options); err != nil {
+		return nil, err
+	}
+	return &discordgo.ThreadsList{Threads: f.threads[guildID]}, nil
+}
+
+func (f *fakeDiscord) ChannelMessagesPinned(channelID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	if err := f.call("ChannelMessagesPinned", channelID, options); err != nil {
+		return nil, err
+	}
+	return f.pinned[channelID], nil
+}
+
+// ChannelMessages pages through the channel like Discord: newest first,
+// limit messages older than beforeID, or the limit oldest messages newer than
+// afterID.
+func (f *fakeDiscord) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	if err := f.call("ChannelMessages", channelID, options); err != nil {
+		return nil, err
+	}
+	// messages は新しい順
+	messages := f.messages[channelID]
+	if afterID != "" {
+		var newer []*discordgo.Message
+		for _, message := range messages {
+			if newerSnowflake(message.ID, afterID) {
+				newer = append(newer, message)
+			}
+		}
+		return newer[max(len(newer)-limit, 0):], nil
+	}
+	var page []*discordgo.Message
+	for _, message := range messages {
+		if (beforeID == "" || newerSnowflake(beforeID, message.ID)) && len(page) < limit {
+			page = append(page, message)
+		}
+	}
+	return page, nil
+}
+
+// fakeSnowflake returns the smallest snowflake of the millisecond at.
+func fakeSnowflake(at time.Time) string {
+	return strconv.FormatInt((at.UnixMilli()-discordEpochMillis)<<22, 10)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// testEpoch is when the fake messages are posted, in the past so that they
+// fall within any lookback a test uses relative to now.
+var testEpoch = time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+
+// fakeMessages returns n messages of the channel, newest first, posted a
+// minute apart with the oldest at testEpoch. Their IDs are the snowflakes of
+// their timestamps, so they sort like real messages.
+func fakeMessages(n int) []*discordgo.Message {
+	messages := make([]*discordgo.Message, n)
+	for i := range messages {
+		at := testEpoch.Add(time.Duration(n-1-i) * time.Minute)
+		messages[i] = &discordgo.Message{
+			ID:        fakeSnowflake(at),
+			Timestamp: at,
+			Author:    &discordgo.User{ID: "1000", Username: "alice"},
+		}
+	}
+	return messages
+}
+
+// fakeTextChannel returns a text channel of the guild with the messages,
+// whose newest one is the channel's last message.
+func fakeTextChannel(guildID, id, name string, messages []*discordgo.Message) *discordgo.Channel {
+	channel := &discordgo.Channel{ID: id, GuildID: guildID, Name: name, Type: discordgo.ChannelTypeGuildText}
+	if len(messages) > 0 {
+		channel.LastMessageID = messages[0].ID
+	}
+	return channel
+}
+
+// addChannel adds a text channel with n fake messages to the guild.
+func (f *fakeDiscord) addChannel(guildID, id, name string, n int) *discordgo.Channel {
+	messages := fakeMessages(n)
+	channel := fakeTextChannel(guildID, id, name, messages)
+	f.channels[guildID] = append(f.channels[guildID], channel)
+	f.messages[id] = messages
+	return channel
+}
+
+// addMembers adds n members with user IDs counting up from 1 to the guild,
+// the first bots of them bots.
+func (f *fakeDiscord) addMembers(guildID string, n, bots int) {
+	for i := 1; i <= n; i++ {
+		user := &discordgo.User{ID: fmt.Sprint(i), Username: fmt.Sprintf("user%d", i), Bot: i <= bots}
+		f.members[guildID] = append(f.members[guildID], &discordgo.Member{GuildID: guildID, User: user})
+	}
+}
+
+func TestFakeDiscordPagesMessages(t *testing.T) {
+	fake := newFakeDiscord()
+	fake.messages["c"] = fakeMessages(5)
+
+	page, _ := fake.ChannelMessages("c", 2, "", "", "")
+	if len(page) != 2 || page[0] != fake.messages["c"][0] {
+		t.Fatalf("first page = %d messages, want the 2 newest", len(page))
+	}
+	page, _ = fake.ChannelMessages("c", 2, page[1].ID, "", "")
+	if len(page) != 2 || page[0] != fake.messages["c"][2] {
+		t.Fatalf("second page does not continue before the first")
+	}
+	// after は指定した ID の直後の古いものから返す
+	page, _ = fake.ChannelMessages("c", 2, "", fake.messages["c"][4].ID, "")
+	if len(page) != 2 || page[0] != fake.messages["c"][2] || page[1] != fake.messages["c"][3] {
+		t.Fatalf("page after the oldest message = %v, want the next 2 newest first", page)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+// customEmojiPattern matches custom (and animated) emoji as they appear in
+// message content, e.g. <:name:123456> or <a:name:123456>.
+var customEmojiPattern = regexp.MustCompile(`<a?:\w{2,32}:\d{17,20}>`)
+
+const zeroWidthJoiner = '‍'
+
+// countEmoji returns the number of custom and unicode emoji in content.
+//
+// Unicode emoji detection is approximate: it counts runes in the common emoji
+// blocks, treats a sequence joined by zero width joiners (e.g. family emoji)
+// as one emoji and a pair of regional indicators as one flag, and ignores
+// variation selectors and skin tone modifiers. It is a single linear pass over
+// the content, which Discord caps at a few thousand characters.
+func countEmoji(content string) int {
+	count := len(customEmojiPattern.FindAllStringIndex(content, -1))
+	content = customEmojiPattern.ReplaceAllString(content, "")
+
+	joined := false
+	regionalIndicators := 0
+	for len(content) > 0 {
+		r, size := utf8.DecodeRuneInString(content)
+		content = content[size:]
+
+		switch {
+		case r == zeroWidthJoiner:
+			joined = true
+			continue
+		case r >= 0x1f1e6 && r <= 0x1f1ff:
+			regionalIndicators++
+			if regionalIndicators%2 == 1 {
+				count++
+			}
+		case isEmojiRune(r):
+			if !joined {
+				count++
+			}
+		}
+		joined = false
+	}
+
+	return count
+}
+
+func isEmojiRune(r rune) bool {
+	switch {
+	case r >= 0x1f3fb && r <= 0x1f3ff: // skin tone modifiers
+		return false
+	case r >= 0x1f300 && r <= 0x1faff:
+		return true
+	case r >= 0x2600 && r <= 0x27bf:
+		return true
+	case r >= 0x2b00 && r <= 0x2bff:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS guild_counts (
+	recorded_at INTEGER NOT NULL,
+	server_id   TEXT    NOT NULL,
+	members     INTEGER,
+	messages    INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS channel_counts (
+	recorded_at  INTEGER NOT NULL,
+	server_id    TEXT    NOT NULL,
+	channel_id   TEXT    NOT NULL,
+	channel_name TEXT    NOT NULL,
+	messages     INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS channel_counts_channel ON channel_counts (channel_id, recorded_at);
+`
+
+// historyStore appends the counts of every cycle to a SQLite database, so that
+// history is kept independently of Prometheus retention.
+type historyStore struct {
+	db *sql.DB
+}
+
+func openHistoryStore(path string) (*historyStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %w", path, err)
+	}
+	return &historyStore{db: db}, nil
+}
+
+// record stores one cycle of all guilds in a single transaction. A guild's
+// members are stored as NULL when they are missing from memberCounts, i.e. when
+// the member count was not collected.
+func (h *historyStore) record(at time.Time, serverIDs []string, memberCounts map[string]int, channels []channelResult) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	recordedAt := at.Unix()
+	totals := make(map[string]int, len(serverIDs))
+	for _, result := range channels {
+		totals[result.channel.GuildID] += result.stats.messages
+		if _, err := tx.Exec(
+			"INSERT INTO channel_counts (recorded_at, server_id, channel_id, channel_name, messages) VALUES (?, ?, ?, ?, ?)",
+			recordedAt, result.channel.GuildID, result.channel.ID, result.channel.Name, result.stats.messages,
+		); err != nil {
+			return err
+		}
+	}
+
+	for _, serverID := range serverIDs {
+		var memberCount sql.NullInt64
+		if members, ok := memberCounts[serverID]; ok {
+			memberCount = sql.NullInt64{Int64: int64(members), Valid: true}
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO guild_counts (recorded_at, server_id, members, messages) VALUES (?, ?, ?, ?)",
+			recordedAt, serverID, memberCount, totals[serverID],
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (h *historyStore) close() error {
+	return h.db.Close()
+}
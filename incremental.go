@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelCursors keeps the running tally of each channel by ID when
+// incrementalCount is enabled. Its newestID is where the next cycle continues.
+var channelCursors = make(map[string]channelStats)
+
+// discordEpochMillis is the Unix time in milliseconds snowflakes count from.
+const discordEpochMillis = 1420070400000
+
+// countNewMessages continues the running tally of a channel that was counted
+// before, paging only through the messages posted since. A channel without
+// messages starts over from zero, and one whose last message is older than the
+// cursor, i.e. whose newest messages were deleted, is counted again in full.
+func countNewMessages(ctx context.Context, discordSession discordClient, channel *discordgo.Channel, joinedAt time.Time, cursor channelStats) (channelStats, error) {
+	switch {
+	case channel.LastMessageID == "":
+		return channelStats{keywords: make([]int, len(config.KeywordPatterns))}, nil
+	case channel.LastMessageID == cursor.newestID:
+		return cursor, nil
+	case newerSnowflake(cursor.newestID, channel.LastMessageID):
+		return countChannelMessages(ctx, discordSession, channel.ID, joinedAt, "")
+	}
+
+	delta, err := countChannelMessages(ctx, discordSession, channel.ID, joinedAt, cursor.newestID)
+	if err != nil {
+		return cursor, err
+	}
+	return cursor.add(delta), nil
+}
+
+// add returns the sum of two tallies of the same channel. newestID is the
+// newer of both.
+func (s channelStats) add(other channelStats) channelStats {
+	sum := channelStats{
+		messages:         s.messages + other.messages,
+		observed:         s.observed + other.observed,
+		reactions:        s.reactions + other.reactions,
+		emoji:            s.emoji + other.emoji,
+		userMentions:     s.userMentions + other.userMentions,
+		roleMentions:     s.roleMentions + other.roleMentions,
+		everyoneMentions: s.everyoneMentions + other.everyoneMentions,
+		orphanedReplies:  s.orphanedReplies + other.orphanedReplies,
+		edited:           s.edited + other.edited,
+		attachments:      s.attachments + other.attachments,
+		embeds:           s.embeds + other.embeds,
+		botMessages:      s.botMessages + other.botMessages,
+		roleMessages:     s.roleMessages + other.roleMessages,
+		keywords:         make([]int, len(config.KeywordPatterns)),
+		newestID:         s.newestID,
+	}
+	for i := range sum.keywords {
+		if i < len(s.keywords) {
+			sum.keywords[i] += s.keywords[i]
+		}
+		if i < len(other.keywords) {
+			sum.keywords[i] += other.keywords[i]
+		}
+	}
+	if config.TopTalkers > 0 {
+		sum.authors = make(map[string]int, len(s.authors))
+		for user, count := range s.authors {
+			sum.authors[user] += count
+		}
+		for user, count := range other.authors {
+			sum.authors[user] += count
+		}
+		// 新しく数えた分のユーザー名を優先する
+		sum.authorNames = make(map[string]string, len(s.authorNames))
+		for _, names := range []map[string]string{s.authorNames, other.authorNames} {
+			for user, name := range names {
+				sum.authorNames[user] = name
+			}
+		}
+	}
+	if config.TopReactionEmoji > 0 {
+		sum.reactionEmoji = make(map[string]int, len(s.reactionEmoji))
+		for emoji, count := range s.reactionEmoji {
+			sum.reactionEmoji[emoji] += count
+		}
+		for emoji, count := range other.reactionEmoji {
+			sum.reactionEmoji[emoji] += count
+		}
+	}
+	if config.MessagesPerDay > 0 {
+		// 期間外になった日は累計から落として、マップが増え続けないようにする
+		first := messageDays(time.Now())[0]
+		sum.days = make(map[string]int, config.MessagesPerDay)
+		for _, days := range []map[string]int{s.days, other.days} {
+			for day, count := range days {
+				if day >= first {
+					sum.days[day] += count
+				}
+			}
+		}
+	}
+	if newerSnowflake(other.newestID, s.newestID) {
+		sum.newestID = other.newestID
+	}
+	return sum
+}
+
+// newerSnowflake reports whether the snowflake a is newer than b. Snowflakes
+// are decimal numbers without leading zeros, so a longer one is always newer.
+// Any snowflake is newer than the empty string.
+func newerSnowflake(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// seedCursor returns the running tally a channel bootstrapped from a peer
+// continues from: the peer's message count, up to the end of the second of the
+// newest message the peer had seen. Only the message count carries over; the
+// other tallies start from zero.
+func seedCursor(channel *discordgo.Channel, seed peerChannel) channelStats {
+	cursor := channelStats{messages: seed.total, keywords: make([]int, len(config.KeywordPatterns))}
+	end := seed.newestAt.Truncate(time.Second).Add(time.Second)
+	if at, err := snowflakeTimestamp(channel.LastMessageID); err == nil && at.Before(end) {
+		// ピアが数えてから新しいメッセージは投稿されていない
+		cursor.newestID = channel.LastMessageID
+	} else {
+		cursor.newestID = snowflakeBefore(end)
+	}
+	return cursor
+}
+
+// snowflakeBefore returns the newest snowflake of a time before t, the cursor
+// to page through the messages posted from t on.
+func snowflakeBefore(t time.Time) string {
+	return strconv.FormatInt((t.UnixMilli()-discordEpochMillis)<<22-1, 10)
+}
+
+// snowflakeTimestamp returns when the snowflake id was generated, from the
+// milliseconds since the Discord epoch in its upper 42 bits.
+func snowflakeTimestamp(id string) (time.Time, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snowflake %q: %w", id, err)
+	}
+	return time.UnixMilli(int64(n>>22) + discordEpochMillis), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIncrementalCount(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.IncrementalCount = true
+	cfg.MessagePageSize = 2
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 5)
+
+	// 最初は全件を数える
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 5)
+	if got := fake.callCount("ChannelMessages"); got != 3 {
+		t.Errorf("first cycle called ChannelMessages %d times, want 3", got)
+	}
+	if cursor := channelCursors[general.ID]; cursor.newestID != general.LastMessageID {
+		t.Errorf("cursor = %s, want the newest message %s", cursor.newestID, general.LastMessageID)
+	}
+
+	// 次のサイクルでは増えた 3 件だけを取得する
+	fake.messages[general.ID] = fakeMessages(8)
+	general.LastMessageID = fake.messages[general.ID][0].ID
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 8)
+	if got := fake.callCount("ChannelMessages") - 3; got != 2 {
+		t.Errorf("second cycle called ChannelMessages %d times, want 2 for the 3 new messages", got)
+	}
+
+	// 新しいメッセージがなければ取得しない
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 8)
+	if got := fake.callCount("ChannelMessages") - 5; got != 0 {
+		t.Errorf("unchanged channel called ChannelMessages %d times, want 0", got)
+	}
+}
+
+func TestIncrementalCountRecountsAfterDeletion(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.IncrementalCount = true
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 5)
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+
+	// 新しい 2 件が削除されて、最後のメッセージがカーソルより古くなった
+	fake.messages[general.ID] = fake.messages[general.ID][2:]
+	general.LastMessageID = fake.messages[general.ID][0].ID
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 3)
+}
+
+func TestSnowflakeTimestamp(t *testing.T) {
+	for id, want := range map[string]time.Time{
+		// Discord のドキュメントの例
+		"175928847299117063": time.Date(2016, 4, 30, 11, 18, 25, 796_000_000, time.UTC),
+		"0":                  time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		"4194304":            time.Date(2015, 1, 1, 0, 0, 0, 1_000_000, time.UTC),
+	} {
+		got, err := snowflakeTimestamp(id)
+		if err != nil {
+			t.Errorf("snowflakeTimestamp(%s): %v", id, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("snowflakeTimestamp(%s) = %v, want %v", id, got.UTC(), want)
+		}
+	}
+	for _, id := range []string{"", "general", "-1"} {
+		if _, err := snowflakeTimestamp(id); err == nil {
+			t.Errorf("snowflakeTimestamp(%q) succeeded, want an error", id)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	inviteUsesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_invite_uses",
+			Help: "Number of times each invite of the Discord server has been used",
+		},
+		[]string{"guild", "code", "inviter"},
+	)
+	// noInvitePermissionLogged keeps the missing permission warning to one per
+	// guild.
+	noInvitePermissionLogged sync.Map
+)
+
+// updateInviteUses sets discord_invite_uses for every invite of the guild.
+// Invites without an inviter, like the vanity URL, get an empty inviter label.
+// Listing invites needs the Manage Server permission; a guild where the bot
+// lacks it is skipped with a single warning and not counted as a failure.
+func updateInviteUses(ctx context.Context, discordSession discordClient, serverID string) bool {
+	invites, err := withRetry(ctx, "get guild invites", func() ([]*discordgo.Invite, error) {
+		apiRequestsCounter.WithLabelValues("GuildInvites").Inc()
+		return discordSession.GuildInvites(serverID, discordgo.WithContext(ctx))
+	})
+	if isForbidden(err) {
+		if _, logged := noInvitePermissionLogged.LoadOrStore(serverID, true); !logged {
+			slog.Warn("Missing the Manage Server permission, skipping discord_invite_uses", "guild", serverID)
+		}
+		inviteUsesGauge.DeletePartialMatch(prometheus.Labels{"guild": serverID})
+		return true
+	}
+	if err != nil {
+		scrapeErrorsCounter.WithLabelValues(metricGroupGuild).Inc()
+		slog.Error("Failed to get guild invites", "guild", serverID, "error", err)
+		return false
+	}
+	noInvitePermissionLogged.Delete(serverID)
+
+	// 期限切れや削除された招待の系列を残さないよう毎回作り直す
+	inviteUsesGauge.DeletePartialMatch(prometheus.Labels{"guild": serverID})
+	for _, invite := range invites {
+		inviter := ""
+		if invite.Inviter != nil {
+			inviter = invite.Inviter.Username
+		}
+		inviteUsesGauge.WithLabelValues(serverID, invite.Code, inviter).Set(float64(invite.Uses))
+	}
+	return true
+}
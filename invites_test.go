@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateInviteUses(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.invites["g1"] = []*discordgo.Invite{
+		{Code: "abc", Uses: 7, Inviter: &discordgo.User{Username: "alice"}},
+		{Code: "vanity", Uses: 40},
+	}
+
+	if !updateInviteUses(context.Background(), fake, "g1") {
+		t.Fatal("updateInviteUses failed")
+	}
+	wantSeries(t, inviteUsesGauge, prometheus.Labels{"guild": "g1", "code": "abc", "inviter": "alice"}, 7)
+	// 招待者のいない招待は inviter が空
+	wantSeries(t, inviteUsesGauge, prometheus.Labels{"guild": "g1", "code": "vanity", "inviter": ""}, 40)
+
+	// 削除された招待の系列は消える
+	fake.invites["g1"] = fake.invites["g1"][1:]
+	updateInviteUses(context.Background(), fake, "g1")
+	wantNoSeries(t, inviteUsesGauge, prometheus.Labels{"guild": "g1", "code": "abc", "inviter": "alice"})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var channelInfoGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_channel_info",
+		Help: "Always 1, mapping the normalized channel label to the channel's real name",
+	},
+	[]string{"channel", "channel_display"},
+)
+
+// normalizeChannelLabel lowercases name and replaces every run of characters
+// other than a-z, 0-9 and _ with a single underscore, trimming them at both
+// ends, e.g. "🎮 Game Night!" becomes "game_night".
+func normalizeChannelLabel(name string) string {
+	var b strings.Builder
+	pending := false
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			if pending && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			pending = false
+			b.WriteRune(r)
+			continue
+		}
+		pending = true
+	}
+	return b.String()
+}
+
+// normalizeChannelNames returns copies of the channels named by their
+// normalized label, along with their real names by channel ID. A channel whose
+// name has nothing left after normalizing, like one made of emoji only, is
+// named by its ID. Channels that end up with the same label are told apart by
+// disambiguateChannelNames afterwards.
+func normalizeChannelNames(channels []*discordgo.Channel) ([]*discordgo.Channel, map[string]string) {
+	result := make([]*discordgo.Channel, 0, len(channels))
+	displayNames := make(map[string]string, len(channels))
+	for _, channel := range channels {
+		displayNames[channel.ID] = channel.Name
+		normalized := *channel
+		normalized.Name = normalizeChannelLabel(channel.Name)
+		if normalized.Name == "" {
+			normalized.Name = channel.ID
+		}
+		result = append(result, &normalized)
+	}
+	return result, displayNames
+}
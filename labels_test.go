@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNormalizeChannelLabel(t *testing.T) {
+	for name, want := range map[string]string{
+		"general":         "general",
+		"🎮 Game Night!":   "game_night",
+		"dev--talk":       "dev_talk",
+		"snake_case_2024": "snake_case_2024",
+		"🎉🎉":              "",
+	} {
+		if got := normalizeChannelLabel(name); got != want {
+			t.Errorf("normalizeChannelLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUpdateMessageCountNormalizesChannelLabels(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.NormalizeChannelLabels = true
+	channelInfoGauge.Reset()
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "🎮 Game Night!", 3)
+	fake.addChannel("g1", "102", "🎉🎉", 1)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "game_night", "channel_id": "101", "category": ""}, 3)
+	wantSeries(t, channelInfoGauge, prometheus.Labels{"channel": "game_night", "channel_display": "🎮 Game Night!"}, 1)
+	// 絵文字だけの名前は ID になる
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "102", "channel_id": "102", "category": ""}, 1)
+	wantSeries(t, channelInfoGauge, prometheus.Labels{"channel": "102", "channel_display": "🎉🎉"}, 1)
+}
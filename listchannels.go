@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// listChannelsOnly is set by --list-channels. main then prints the channels of
+// the configured servers with listChannels and exits without serving metrics.
+var listChannelsOnly bool
+
+// listChannels writes a table of the channels of every server to w, headed by
+// the server ID when there are several.
+func listChannels(w io.Writer, discordSession discordClient, serverIDs []string) error {
+	ctx := context.Background()
+	for i, serverID := range serverIDs {
+		channels, err := withRetry(ctx, "get guild channels", func() ([]*discordgo.Channel, error) {
+			apiRequestsCounter.WithLabelValues("GuildChannels").Inc()
+			return discordSession.GuildChannels(serverID, discordgo.WithContext(ctx))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get the channels of server %s: %w", serverID, err)
+		}
+		if len(serverIDs) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "# server %s\n", serverID)
+		}
+		if err := formatChannelTable(w, channels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatChannelTable writes the name, ID and type of the channels as aligned
+// columns, sorted by name. The names are the ones includeChannels and
+// excludeChannels match against.
+func formatChannelTable(w io.Writer, channels []*discordgo.Channel) error {
+	sorted := make([]*discordgo.Channel, len(channels))
+	copy(sorted, channels)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tTYPE")
+	for _, channel := range sorted {
+		channelType, ok := channelTypeNames[channel.Type]
+		switch {
+		case channel.IsThread():
+			channelType = "thread"
+		case !ok:
+			channelType = "other"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", channel.Name, channel.ID, channelType)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestFormatChannelTable(t *testing.T) {
+	var out strings.Builder
+	err := formatChannelTable(&out, []*discordgo.Channel{
+		{ID: "103", Name: "voice-lounge", Type: discordgo.ChannelTypeGuildVoice},
+		{ID: "102", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		{ID: "101", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		{ID: "301", Name: "help", Type: discordgo.ChannelTypeGuildPublicThread},
+		{ID: "104", Name: "directory", Type: discordgo.ChannelTypeGuildStore},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 名前順、同名なら ID 順に揃えて出す
+	want := `NAME          ID   TYPE
+directory     104  other
+general       101  text
+general       102  text
+help          301  thread
+voice-lounge  103  voice
+`
+	if out.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestListChannelsHeadsEachServer(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 0)
+	fake.addChannel("g2", "201", "news", 0)
+
+	var out strings.Builder
+	if err := listChannels(&out, fake, []string{"g1", "g2"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "# server g1\nNAME     ID   TYPE\ngeneral  101  text\n\n# server g2\nNAME  ID   TYPE\nnews  201  text\n"
+	if out.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	fake.fail = func(ctx context.Context, method, id string) error {
+		return restError(http.StatusForbidden)
+	}
+	if err := listChannels(&out, fake, []string{"g1"}); err == nil || !strings.Contains(err.Error(), "server g1") {
+		t.Errorf("err = %v, want the failed server reported", err)
+	}
+}
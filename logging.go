@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	defaultLogFormat = "text"
+	defaultLogLevel  = "info"
+)
+
+// parseLogLevel maps the logLevel config values to slog levels.
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid logLevel %q: must be debug, info, warn or error", level)
+	}
+}
+
+// newLogger returns a logger writing to stderr in the configured format. It is
+// installed as the default logger, which the log package then writes through
+// as well.
+func newLogger(config *Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: config.LogLevel}
+	if config.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
@@ -1,130 +1,2323 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/spf13/viper"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/spf13/pflag"
 )
 
+const (
+	defaultUpdateInterval = 15 * time.Minute
+	// shutdownTimeout bounds how long a running cycle and open HTTP requests
+	// may take to finish on SIGINT/SIGTERM.
+	shutdownTimeout              = 30 * time.Second
+	maxMembersPerRequest         = 1000
+	maxMessagesPerRequest        = 100
+	defaultMaxConcurrentChannels = 5
+	// A channel that fails circuitBreakerThreshold cycles in a row is skipped
+	// for an exponentially growing number of cycles, up to
+	// maxCircuitBreakerBackoff, before it is probed again.
+	circuitBreakerThreshold  = 3
+	maxCircuitBreakerBackoff = 32
+)
+
+// channelStats holds everything tallied while paginating one channel.
+type channelStats struct {
+	messages  int
+	observed  int
+	reactions int
+	emoji     int
+	// Mentions by type, see discord_mentions_count.
+	userMentions     int
+	roleMentions     int
+	everyoneMentions int
+	orphanedReplies  int
+	edited           int
+	attachments      int
+	embeds           int
+	keywords         []int
+	// botMessages are the messages posted by bots and webhooks.
+	botMessages int
+	// roleMessages are the messages posted by holders of countRoleID.
+	roleMessages int
+	// authors counts the messages per author ID, for topTalkers, and
+	// authorNames holds the username of the first message counted of each
+	// author, the newest one when paging back, which labels their series.
+	authors     map[string]int
+	authorNames map[string]string
+	// reactionEmoji counts the reactions per emoji, for topReactionEmoji.
+	reactionEmoji map[string]int
+	// days counts the messages per date, for messagesPerDay.
+	days map[string]int
+	// pinned is fetched separately every cycle and not added up.
+	pinned int
+	// capped is set when counting stopped at maxMessagePagesPerChannel, so
+	// messages is a lower bound.
+	capped bool
+	// ageBuckets holds the cumulative number of messages per
+	// messageAgeBuckets bound, and ageSum the sum of their ages in seconds.
+	ageBuckets []uint64
+	ageSum     float64
+	// newestID is the ID of the newest message seen, where incremental
+	// counting continues.
+	newestID string
+}
+
+// channelTrend is the per-channel state carried between cycles to derive
+// message rate and acceleration.
+type channelTrend struct {
+	messages   int
+	observedAt time.Time
+	rate       float64
+	hasRate    bool
+}
+
+type channelBreaker struct {
+	failures   int
+	skipCycles int
+}
+
+// cycleHistogram exposes values observed in the last cycle, such as the
+// per-channel totals, as a histogram. Unlike prometheus.Histogram it is
+// replaced every cycle rather than accumulating observations, so the buckets
+// always describe the current server.
+type cycleHistogram struct {
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+func (h *cycleHistogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *cycleHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstHistogram(h.desc, h.count, h.sum, h.buckets)
+}
+
+func (h *cycleHistogram) set(bounds []float64, totals []int) {
+	buckets := make(map[float64]uint64, len(bounds))
+	var sum float64
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+	for _, total := range totals {
+		sum += float64(total)
+		for _, bound := range bounds {
+			if float64(total) <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+
+	h.setCounts(uint64(len(totals)), sum, buckets)
+}
+
+// setCounts replaces the histogram with count observations summing to sum,
+// where buckets holds the cumulative count of each upper bound.
+func (h *cycleHistogram) setCounts(count uint64, sum float64, buckets map[float64]uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count = count
+	h.sum = sum
+	h.buckets = buckets
+}
+
+type channelResult struct {
+	channel *discordgo.Channel
+	stats   channelStats
+	err     error
+}
+
 var (
-	discordSession   *discordgo.Session
-	serverID         string
-	memberCountGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "discord_members_count",
-		Help: "Number of members in the Discord server",
+	config *Config
+	// discordSession is the Discord client the collection cycles use. main
+	// sets it to the *discordgo.Session it opens.
+	discordSession discordClient
+	serverIDs      []string
+	// lastChannelTotals keeps the previous cycle's message count per channel ID
+	// and is used to schedule the largest channels first.
+	lastChannelTotals = make(map[string]int)
+	// peerTotals are the totals by channel name bootstrapped from peerURL,
+	// used as size estimates until a channel has been counted once.
+	peerTotals map[string]int
+	// peerSeeds are the series bootstrapped from peerURL by channel ID that
+	// incrementalCount continues from until the channel has a cursor of its
+	// own.
+	peerSeeds     map[string]peerChannel
+	channelTrends = make(map[string]channelTrend)
+	// lastMemberCounts keeps the previous cycle's member count and its source
+	// per guild, the baseline of discord_member_delta.
+	lastMemberCounts = make(map[string]memberCountSample)
+	// roleLabels are the role names exported per guild in the previous
+	// cycle, so that series of renamed and deleted roles can be deleted.
+	roleLabels = make(map[string]map[string]bool)
+	// knownChannels are the channels by ID that had series in the previous
+	// cycle, see forgetRemovedChannels.
+	knownChannels   = make(map[string]*discordgo.Channel)
+	channelBreakers = make(map[string]*channelBreaker)
+	// channelCategories is the category label each channel's message count
+	// was exported with, so that it can be replaced once the channel is moved
+	// or its category renamed.
+	channelCategories = make(map[string]string)
+	// noAccessLogged holds the channels whose missing access has been
+	// logged, so that it is logged once rather than every cycle.
+	noAccessLogged = make(map[string]bool)
+	// botJoinedAt is when the bot joined each guild, refreshed every cycle.
+	// It is zero for a guild when the lookup failed.
+	botJoinedAt = make(map[string]time.Time)
+	// guildTextChannels are the counted text channels of each guild as last
+	// listed, before disambiguateChannelNames, so that the channels of guilds
+	// not listed in a cycle keep their part in it.
+	guildTextChannels = make(map[string][]*discordgo.Channel)
+	// lastGuildCounts is when the channels of each guild were last listed for
+	// a message count, see dueGuilds.
+	lastGuildCounts = make(map[string]time.Time)
+	// history is nil unless sqlitePath is configured.
+	history *historyStore
+	// cycleMu serializes the collection cycles of the timed loop,
+	// collectOnScrape scrapes and /refresh.
+	cycleMu sync.Mutex
+	// scrapesInFlight counts collection cycles that are currently running.
+	scrapesInFlight      atomic.Int32
+	scrapesInFlightGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "discord_scrapes_in_flight",
+		Help: "Number of collection cycles currently running",
+	}, func() float64 {
+		return float64(scrapesInFlight.Load())
+	})
+	// rateLimitWait accumulates the time spent sleeping on 429 responses during
+	// the current cycle, in nanoseconds.
+	rateLimitWait      atomic.Int64
+	rateLimitWaitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_rate_limit_wait_seconds",
+		Help: "Total time spent waiting on Discord rate limits during the last collection cycle",
+	})
+	// startedAt and lastCycleSuccess (Unix nanoseconds, 0 until the first
+	// cycle completes) back the freshness health check.
+	startedAt        = time.Now()
+	lastCycleSuccess atomic.Int64
+	// lastScrapeSuccess (Unix nanoseconds) is the end of the last cycle in
+	// which every enabled phase succeeded. It backs /healthz.
+	lastScrapeSuccess atomic.Int64
+	// channelWorkers bounds concurrent channel counting. It is sized by
+	// maxConcurrentChannels and can be resized through the /workers endpoint.
+	channelWorkers      = newWorkerPool(defaultMaxConcurrentChannels)
+	workerPoolSizeGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "discord_worker_pool_size",
+		Help: "Maximum number of channels counted concurrently",
+	}, func() float64 {
+		return float64(channelWorkers.currentSize())
+	})
+	messageScrapeDurationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_message_scrape_duration_seconds",
+		Help: "Duration of the last message counting cycle",
+	})
+	memberScrapeDurationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_member_scrape_duration_seconds",
+		Help: "Duration of the last member counting cycle",
+	})
+	scrapeErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discord_scrape_errors_total",
+			Help: "Number of failed Discord API fetches by collection phase",
+		},
+		[]string{"phase"},
+	)
+	collectorRestartsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_collector_restarts_total",
+		Help: "Number of collection cycles that panicked and were recovered from",
+	})
+	scrapeTimeoutsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_scrape_timeouts_total",
+		Help: "Number of collection cycles aborted for running longer than cycleTimeout",
+	})
+	// scrapeOverlapsCounter counts the timed cycles that were due while the
+	// previous cycle, timed or not, was still running.
+	scrapeOverlapsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_scrape_overlaps_total",
+		Help: "Number of timed collection cycles that were due while the previous cycle was still running",
+	})
+	scrapeCycleBehindGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_scrape_cycle_behind_seconds",
+		Help: "How late the last timed collection cycle started after its tick",
+	})
+	lastScrapeSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_last_scrape_success_timestamp_seconds",
+		Help: "Unix time of the last collection cycle in which every enabled phase succeeded",
+	})
+	lastPhaseSuccessGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_last_phase_success_timestamp_seconds",
+			Help: "Unix time of the last successful update by collection phase",
+		},
+		[]string{"phase"},
+	)
+	scrapeUpGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_scrape_up",
+			Help: "1 if the last cycle fetched the member counts or channel lists of all servers, by phase, 0 otherwise",
+		},
+		[]string{"phase"},
+	)
+	// collectorPaused is toggled by the /pause and /resume endpoints.
+	collectorPaused      atomic.Bool
+	collectorPausedGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "discord_collector_paused",
+		Help: "Whether the background collector is paused (1 or 0)",
+	}, func() float64 {
+		return boolToFloat(collectorPaused.Load())
+	})
+	messageCountDistribution = &cycleHistogram{
+		desc: prometheus.NewDesc(
+			"discord_channel_message_count_distribution",
+			"Distribution of message counts across channels in the last cycle",
+			nil, nil,
+		),
+	}
+	channelsNoAccessGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channels_no_access",
+			Help: "Number of channels skipped in the last cycle because the bot can't read them",
+		},
+		[]string{"guild"},
+	)
+	channelsExcludedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channels_excluded_count",
+			Help: "Number of text channels skipped in the last cycle because they are excluded",
+		},
+		[]string{"guild"},
+	)
+	channelsExcludedUnmatchedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_channels_excluded_unmatched",
+		Help: "Number of excludeChannels and excludeChannelIDs entries that matched none of the channels in the last cycle",
+	})
+	messageAgeHistogram = &cycleHistogram{
+		desc: prometheus.NewDesc(
+			"discord_message_age_seconds",
+			"Distribution of the age of the messages counted in the last cycle",
+			nil, nil,
+		),
+	}
+	memberCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_members_count",
+			Help: "Number of members in the Discord server, counted from the member list (source exact) or estimated by Discord (source approximate)",
+		},
+		[]string{"guild", "source"},
+	)
+	memberDeltaGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_member_delta",
+			Help: "Change of the member count of the Discord server since the previous collection cycle",
+		},
+		[]string{"guild"},
+	)
+	membersByTypeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_members_by_type_count",
+			Help: "Number of members in the Discord server by account type (human or bot)",
+		},
+		[]string{"guild", "type"},
+	)
+	membersByRoleGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_members_by_role_count",
+			Help: "Number of members holding each role",
+		},
+		[]string{"guild", "role"},
+	)
+	membersWithFlagGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_members_with_flag_count",
+			Help: "Number of members with a public user flag (badge)",
+		},
+		[]string{"guild", "flag"},
+	)
+	messageCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_message_count",
+			Help: "Number of messages per channel",
+		},
+		[]string{"guild", "channel", "channel_id", "category"},
+	)
+	messageCountTotalGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_message_count_total",
+			Help: "Number of messages in all channels of the Discord server that were counted in the last cycle",
+		},
+		[]string{"guild"},
+	)
+	messagesPerMemberGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_messages_per_member",
+			Help: "Messages in the counted channels of the Discord server divided by its members",
+		},
+		[]string{"guild"},
+	)
+	recentMessageCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_recent_message_count",
+			Help: "Number of messages per channel posted within messageLookback",
+		},
+		[]string{"guild", "channel", "channel_id", "category"},
+	)
+	keywordMessageCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_keyword_messages_count",
+			Help: "Number of messages per channel matching a configured keyword pattern",
+		},
+		[]string{"channel", "keyword"},
+	)
+	messageRateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channel_message_rate",
+			Help: "Messages per second in each channel since the previous cycle",
+		},
+		[]string{"channel"},
+	)
+	messagesLastIntervalGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_messages_last_interval",
+			Help: "Number of messages posted in each channel since the previous cycle",
+		},
+		[]string{"channel"},
+	)
+	messageAccelerationGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channel_message_acceleration",
+			Help: "Change in discord_channel_message_rate since the previous cycle",
+		},
+		[]string{"channel"},
+	)
+	observedMessageCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_observed_message_count",
+			Help: "Number of messages per channel sent since the bot joined the Discord server",
+		},
+		[]string{"channel"},
+	)
+	lastMessagePositionGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channel_last_message_position",
+			Help: "Snowflake ID of the last message in each channel, a monotonic proxy for channel growth (not a message count)",
+		},
+		[]string{"channel"},
+	)
+	lastMessageTimestampGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channel_last_message_timestamp_seconds",
+			Help: "Unix time of the newest message in each channel; absent for channels without messages",
+		},
+		[]string{"channel"},
+	)
+	channelCreatedTimestampGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channel_created_timestamp_seconds",
+			Help: "Unix time each channel was created at, taken from its ID",
+		},
+		[]string{"channel"},
+	)
+	reactionCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_reaction_count",
+			Help: "Number of reactions on the messages of each channel",
+		},
+		[]string{"channel"},
+	)
+	reactionsPerMessageGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_reactions_per_message",
+			Help: "Average number of reactions per message in each channel",
+		},
+		[]string{"channel"},
+	)
+	emojiUsedCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_message_emoji_used_count",
+			Help: "Number of emoji used in message content per channel",
+		},
+		[]string{"channel"},
+	)
+	mentionsCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_mentions_count",
+			Help: "Number of mentions in messages per channel and mention type (user, role, everyone)",
+		},
+		[]string{"channel", "type"},
+	)
+	orphanedRepliesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_orphaned_replies_count",
+			Help: "Number of replies per channel whose referenced message has been deleted",
+		},
+		[]string{"channel"},
+	)
+	editedMessagesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_edited_messages_count",
+			Help: "Number of messages per channel that have been edited",
+		},
+		[]string{"channel"},
+	)
+	messagesByAuthorTypeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_message_count_by_author_type",
+			Help: "Number of messages per channel by author type (human or bot)",
+		},
+		[]string{"channel", "author_type"},
+	)
+	messageCountCappedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_message_count_capped",
+			Help: "1 if counting the channel stopped at maxMessagePagesPerChannel, so its message count is a lower bound, 0 otherwise",
+		},
+		[]string{"channel"},
+	)
+	pinnedMessageCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_pinned_message_count",
+			Help: "Number of pinned messages in each channel",
+		},
+		[]string{"channel"},
+	)
+	attachmentCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_attachment_count",
+			Help: "Number of attachments in the messages of each channel",
+		},
+		[]string{"channel"},
+	)
+	embedCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_embed_count",
+			Help: "Number of embeds in the messages of each channel",
+		},
+		[]string{"channel"},
+	)
+	attachmentCountTotalGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_attachment_count_total",
+			Help: "Number of attachments in the messages of all channels of the Discord server that were counted in the last cycle",
+		},
+		[]string{"guild"},
+	)
+	embedCountTotalGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_embed_count_total",
+			Help: "Number of embeds in the messages of all channels of the Discord server that were counted in the last cycle",
+		},
+		[]string{"guild"},
+	)
+	circuitOpenGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channel_circuit_open",
+			Help: "Whether message counting is suspended for a channel after repeated failures (1 or 0)",
+		},
+		[]string{"channel"},
+	)
+	guildDefaultNotificationsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_default_notifications",
+			Help: "Default message notification level of the Discord server (0 = all messages, 1 = only mentions)",
+		},
+		[]string{"guild"},
+	)
+	channelsPerSecondGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_channels_per_second",
+		Help: "Channels counted successfully per second in the last message counting cycle",
+	})
+	channelsProcessedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_channels_processed",
+		Help: "Channels the running or last message counting cycle has finished, successfully or not",
+	})
+	channelsTotalGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_channels_total",
+		Help: "Channels to count in the running or last message counting cycle",
+	})
+	categoryCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_category_count",
+			Help: "Number of channel categories in the Discord server",
+		},
+		[]string{"guild"},
+	)
+	guildPremiumTierGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_premium_tier",
+			Help: "Server boost level of the Discord server (0 to 3)",
+		},
+		[]string{"guild"},
+	)
+	guildPremiumSubscriptionsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_premium_subscription_count",
+			Help: "Number of boosts the Discord server has",
+		},
+		[]string{"guild"},
+	)
+	channelsCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_channels_count",
+			Help: "Number of channels in the Discord server by channel type",
+		},
+		[]string{"guild", "type"},
+	)
+	rolesCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_roles_count",
+			Help: "Number of roles in the Discord server, not counting @everyone",
+		},
+		[]string{"guild"},
+	)
+	guildHasIconGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_has_icon",
+			Help: "Whether the Discord server has an icon configured (1 or 0)",
+		},
+		[]string{"guild"},
+	)
+	guildHasBannerGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_has_banner",
+			Help: "Whether the Discord server has a banner configured (1 or 0)",
+		},
+		[]string{"guild"},
+	)
+	guildHasVanityURLGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_guild_has_vanity_url",
+			Help: "Whether the Discord server has a vanity URL configured (1 or 0)",
+		},
+		[]string{"guild"},
+	)
+)
+
+// registerMetrics registers the exporter's own metrics and the collectors of
+// the enabled metric groups, with metricNamespace prepended to their names and
+// constantLabels added. Metrics of disabled groups are neither registered nor
+// collected. It fails if a constant label collides with a label of a metric.
+func registerMetrics(registry *prometheus.Registry, config *Config) error {
+	registerer := prometheus.WrapRegistererWith(config.ConstantLabels, prometheus.WrapRegistererWithPrefix(config.MetricPrefix(), registry))
+	for _, collector := range []prometheus.Collector{
+		buildInfoGauge,
+		rateLimitedCounter,
+		apiRequestsCounter,
+		scrapesInFlightGauge,
+		rateLimitWaitGauge,
+		collectorPausedGauge,
+		workerPoolSizeGauge,
+		messageScrapeDurationGauge,
+		memberScrapeDurationGauge,
+		scrapeErrorsCounter,
+		collectorRestartsCounter,
+		scrapeTimeoutsCounter,
+		scrapeOverlapsCounter,
+		scrapeCycleBehindGauge,
+		lastScrapeSuccessGauge,
+		lastPhaseSuccessGauge,
+		scrapeUpGauge,
+		configReloadsCounter,
+		configReloadErrorsCounter,
+		cacheHitsCounter,
+		cacheMissesCounter,
+		configLastReloadGauge,
+		newDiscordCollector(config),
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range knownMetricGroups {
+		if config.MetricEnabled(group) {
+			scrapeErrorsCounter.WithLabelValues(group)
+		}
+	}
+	return nil
+}
+
+// startMetricsCollector runs a collection cycle every update interval until
+// ctx is cancelled, starting after a random delay of up to scrapeJitter.
+// Cancelling ctx also aborts a running cycle.
+func startMetricsCollector(ctx context.Context, discordSession discordClient, serverIDs []string) {
+	// 同時に再起動したエクスポーターが揃って Discord API を叩かないよう最初のサイクルをずらす
+	if config.ScrapeJitter > 0 {
+		delay := randomJitter(config.ScrapeJitter)
+		slog.Info("Delaying the first collection cycle", "delay", delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return
+		}
+	}
+
+	interval := currentUpdateInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// due は今回のサイクルの tick の時刻、lastEnd は前回のサイクルの終了時刻
+	due := time.Now()
+	var lastEnd time.Time
+	for {
+		if collectorPaused.Load() {
+			slog.Info("Collector is paused, skipping this cycle")
+		} else {
+			runTimedCycle(ctx, discordSession, serverIDs, due, lastEnd)
+			lastEnd = time.Now()
+		}
+		// updateInterval は設定の再読み込みで変わることがある
+		if next := currentUpdateInterval(); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case due = <-ticker.C:
+		}
+	}
+}
+
+// runTimedCycle runs the cycle of the timed loop that was due at due. Since
+// the ticker keeps one tick while a cycle runs, a tick that fired before the
+// previous timed cycle ended at lastEnd, or while a /refresh or
+// collectOnScrape cycle holds cycleMu, is counted as an overlap before waiting
+// for cycleMu.
+func runTimedCycle(ctx context.Context, discordSession discordClient, serverIDs []string, due, lastEnd time.Time) {
+	overlap := due.Before(lastEnd)
+	if !cycleMu.TryLock() {
+		overlap = true
+		cycleMu.Lock()
+	}
+	defer cycleMu.Unlock()
+
+	behind := time.Since(due)
+	scrapeCycleBehindGauge.Set(behind.Seconds())
+	if overlap {
+		scrapeOverlapsCounter.Inc()
+		slog.Warn("Collection cycle is behind schedule, the previous cycle was still running", "behind", behind)
+	}
+	runRecoveredCycle(ctx, discordSession, serverIDs)
+}
+
+// randomJitter returns a random duration in [0, bound).
+func randomJitter(bound time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(bound)))
+}
+
+// runRecoveredCycle runs a collection cycle and recovers from a panic in it,
+// counting it in discord_collector_restarts_total, so that the collector keeps
+// running with the next cycle instead of freezing the metrics. It reports
+// whether every enabled phase succeeded. The caller holds cycleMu.
+func runRecoveredCycle(ctx context.Context, discordSession discordClient, serverIDs []string) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			collectorRestartsCounter.Inc()
+			slog.Error("Recovered from panic in collection cycle", "panic", r, "stack", string(debug.Stack()))
+			ok = false
+		}
+	}()
+	return runCollectionCycle(ctx, discordSession, serverIDs)
+}
+
+// runCollectionCycle updates the metrics of the enabled groups once. The cycle
+// has to finish within cycleTimeout, one update interval by default; if it
+// runs past that or ctx is cancelled, the requests in flight are abandoned and
+// the cycle is aborted without recording history or marking the scrape
+// successful. The channels counted until then keep their new values. It
+// reports whether every enabled phase succeeded.
+func runCollectionCycle(ctx context.Context, discordSession discordClient, serverIDs []string) bool {
+	scrapesInFlight.Add(1)
+	defer scrapesInFlight.Add(-1)
+
+	ctx, cancel := context.WithTimeout(ctx, currentCycleTimeout())
+	defer cancel()
+
+	rateLimitWait.Store(0)
+	allSucceeded := true
+	phaseSucceeded := func(phase string, ok bool) {
+		if ok {
+			lastPhaseSuccessGauge.WithLabelValues(phase).SetToCurrentTime()
+		} else {
+			allSucceeded = false
+		}
+	}
+
+	var memberCounts map[string]int
+	if config.MetricEnabled(metricGroupMembers) {
+		start := time.Now()
+		memberCounts = updateMemberCount(ctx, discordSession, serverIDs)
+		memberScrapeDurationGauge.Set(time.Since(start).Seconds())
+		scrapeUpGauge.WithLabelValues(metricGroupMembers).Set(boolToFloat(len(memberCounts) == len(serverIDs)))
+		phaseSucceeded(metricGroupMembers, len(memberCounts) == len(serverIDs))
+	}
+	state := sessionState(discordSession)
+	if config.ActivityTopN > 0 {
+		updateActivityCount(state, serverIDs)
+	}
+	if config.CountOnline {
+		updateOnlineCount(state, serverIDs)
+	}
+	if config.CountVoiceMembers {
+		updateVoiceChannelMembers(state, serverIDs)
+	}
+	if config.MetricEnabled(metricGroupGuild) {
+		ok := true
+		for _, serverID := range serverIDs {
+			if !updateGuildInfo(ctx, discordSession, serverID) {
+				ok = false
+			}
+			if config.CountBans && !updateBanCount(ctx, discordSession, serverID) {
+				ok = false
+			}
+			if config.CountInvites && !updateInviteUses(ctx, discordSession, serverID) {
+				ok = false
+			}
+		}
+		phaseSucceeded(metricGroupGuild, ok)
+	}
+	var channels []channelResult
+	// countedGuilds are the guilds whose messages are counted in this cycle
+	countedGuilds := serverIDs
+	if config.MetricEnabled(metricGroupMessages) {
+		countedGuilds = dueGuilds(serverIDs, time.Now())
+		var ok bool
+		channels, ok = updateMessageCount(ctx, discordSession, countedGuilds)
+		phaseSucceeded(metricGroupMessages, ok)
+	}
+
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			scrapeTimeoutsCounter.Inc()
+		}
+		// 途中で打ち切ったサイクルの結果は記録しない
+		slog.Warn("Collection cycle aborted", "error", err)
+		return false
+	}
+
+	if config.MetricEnabled(metricGroupMembers) && config.MetricEnabled(metricGroupMessages) {
+		updateMessagesPerMember(memberCounts, countedGuilds, channels)
+	}
+	if history != nil {
+		// 数えなかったギルドのメッセージ数を 0 として記録しないよう、数えたギルドだけ記録する
+		if err := history.record(time.Now(), countedGuilds, memberCounts, channels); err != nil {
+			slog.Error("Failed to record history", "error", err)
+		}
+	}
+
+	if allSucceeded {
+		lastScrapeSuccess.Store(time.Now().UnixNano())
+		lastScrapeSuccessGauge.SetToCurrentTime()
+	}
+	lastCycleSuccess.Store(time.Now().UnixNano())
+	rateLimitWaitGauge.Set(time.Duration(rateLimitWait.Load()).Seconds())
+	return allSucceeded
+}
+
+// updateMessagesPerMember sets discord_messages_per_member for the guilds of
+// serverIDs, whose messages were counted this cycle, with both a member count
+// and at least one counted channel. Guilds without members are skipped rather
+// than divided by zero. The other guilds keep their previous value.
+func updateMessagesPerMember(memberCounts map[string]int, serverIDs []string, channels []channelResult) {
+	totals := make(map[string]int)
+	for _, result := range channels {
+		totals[result.channel.GuildID] += result.stats.messages
+	}
+	for _, serverID := range serverIDs {
+		members, ok := memberCounts[serverID]
+		if !ok {
+			continue
+		}
+		total, counted := totals[serverID]
+		if !counted || members == 0 {
+			messagesPerMemberGauge.DeleteLabelValues(serverID)
+			continue
+		}
+		messagesPerMemberGauge.WithLabelValues(serverID).Set(float64(total) / float64(members))
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func updateGuildInfo(ctx context.Context, discordSession discordClient, serverID string) bool {
+	guild, err := withRetry(ctx, "get guild", func() (*discordgo.Guild, error) {
+		apiRequestsCounter.WithLabelValues("Guild").Inc()
+		return discordSession.Guild(serverID, discordgo.WithContext(ctx))
+	})
+	if err != nil {
+		scrapeErrorsCounter.WithLabelValues(metricGroupGuild).Inc()
+		slog.Error("Failed to get guild", "guild", serverID, "error", err)
+		return false
+	}
+
+	guildHasIconGauge.WithLabelValues(serverID).Set(boolToFloat(guild.Icon != ""))
+	guildHasBannerGauge.WithLabelValues(serverID).Set(boolToFloat(guild.Banner != ""))
+	guildHasVanityURLGauge.WithLabelValues(serverID).Set(boolToFloat(guild.VanityURLCode != ""))
+	guildDefaultNotificationsGauge.WithLabelValues(serverID).Set(float64(guild.DefaultMessageNotifications))
+	guildPremiumTierGauge.WithLabelValues(serverID).Set(float64(guild.PremiumTier))
+	guildPremiumSubscriptionsGauge.WithLabelValues(serverID).Set(float64(guild.PremiumSubscriptionCount))
+
+	roles := 0
+	for _, role := range guild.Roles {
+		if role.ID != serverID {
+			roles++
+		}
+	}
+	rolesCountGauge.WithLabelValues(serverID).Set(float64(roles))
+
+	channels, err := withRetry(ctx, "get guild channels", func() ([]*discordgo.Channel, error) {
+		apiRequestsCounter.WithLabelValues("GuildChannels").Inc()
+		return discordSession.GuildChannels(serverID, discordgo.WithContext(ctx))
+	})
+	if err != nil {
+		scrapeErrorsCounter.WithLabelValues(metricGroupGuild).Inc()
+		slog.Error("Failed to get channels", "guild", serverID, "error", err)
+		return false
+	}
+	for channelType, count := range countChannelsByType(channels) {
+		channelsCountGauge.WithLabelValues(serverID, channelType).Set(float64(count))
+	}
+	return true
+}
+
+// channelTypeNames are the type label values of discord_channels_count.
+// Channel types not listed here are counted as "other".
+var channelTypeNames = map[discordgo.ChannelType]string{
+	discordgo.ChannelTypeGuildText:       "text",
+	discordgo.ChannelTypeGuildVoice:      "voice",
+	discordgo.ChannelTypeGuildCategory:   "category",
+	discordgo.ChannelTypeGuildNews:       "announcement",
+	discordgo.ChannelTypeGuildStageVoice: "stage",
+	discordgo.ChannelTypeGuildForum:      "forum",
+}
+
+// countChannelsByType counts channels per type label. Every label is present,
+// so that a type whose last channel was deleted drops to zero.
+func countChannelsByType(channels []*discordgo.Channel) map[string]int {
+	counts := map[string]int{"other": 0}
+	for _, name := range channelTypeNames {
+		counts[name] = 0
+	}
+	for _, channel := range channels {
+		name, ok := channelTypeNames[channel.Type]
+		if !ok {
+			name = "other"
+		}
+		counts[name]++
+	}
+	return counts
+}
+
+// updateMemberCount returns the member count of every guild whose members
+// could be fetched.
+func updateMemberCount(ctx context.Context, discordSession discordClient, serverIDs []string) map[string]int {
+	memberCounts := make(map[string]int, len(serverIDs))
+	for _, serverID := range serverIDs {
+		members, err := fetchAllMembers(ctx, discordSession, serverID)
+		if err != nil {
+			// Server Members intent がないとメンバー一覧は取れないが、概算の人数は取れる
+			if count, ok := fetchApproximateMemberCount(ctx, discordSession, serverID, err); ok {
+				memberCounts[serverID] = count
+				updateMemberDelta(serverID, "approximate", count)
+			}
+			continue
+		}
+
+		memberCount := len(members)
+		memberCountGauge.DeleteLabelValues(serverID, "approximate")
+		memberCountGauge.WithLabelValues(serverID, "exact").Set(float64(memberCount))
+		updateMemberDelta(serverID, "exact", memberCount)
+		bots := 0
+		for _, member := range members {
+			if member.User != nil && member.User.Bot {
+				bots++
+			}
+		}
+		membersByTypeGauge.WithLabelValues(serverID, "human").Set(float64(memberCount - bots))
+		membersByTypeGauge.WithLabelValues(serverID, "bot").Set(float64(bots))
+		slog.Info("Member count updated", "guild", serverID, "count", memberCount, "source", "exact")
+		memberCounts[serverID] = memberCount
+		if config.CountRoles {
+			updateRoleCount(ctx, discordSession, serverID, members)
+		}
+
+		for _, name := range config.MemberFlags {
+			flag := memberFlags[name]
+			count := 0
+			for _, member := range members {
+				if member.User != nil && member.User.PublicFlags&flag != 0 {
+					count++
+				}
+			}
+			membersWithFlagGauge.WithLabelValues(serverID, name).Set(float64(count))
+		}
+	}
+	return memberCounts
+}
+
+// memberCountSample is a guild's member count with its source, exact or
+// approximate.
+type memberCountSample struct {
+	count  int
+	source string
+}
+
+// updateMemberDelta sets discord_member_delta to the change from the guild's
+// member count in the previous cycle. The first count of a guild has no
+// baseline, and a count from a different source than the previous one would
+// show the gap between the exact and approximate counts rather than a change,
+// so neither sets a delta.
+func updateMemberDelta(serverID, source string, count int) {
+	prev, ok := lastMemberCounts[serverID]
+	lastMemberCounts[serverID] = memberCountSample{count: count, source: source}
+	if !ok || prev.source != source {
+		memberDeltaGauge.DeleteLabelValues(serverID)
+		return
+	}
+	memberDeltaGauge.WithLabelValues(serverID).Set(float64(count - prev.count))
+}
+
+// updateRoleCount counts the members of each role of the guild, except
+// @everyone. Roles sharing a name are added up.
+func updateRoleCount(ctx context.Context, discordSession discordClient, serverID string, members []*discordgo.Member) {
+	roles, err := withRetry(ctx, "get guild roles", func() ([]*discordgo.Role, error) {
+		apiRequestsCounter.WithLabelValues("GuildRoles").Inc()
+		return discordSession.GuildRoles(serverID, discordgo.WithContext(ctx))
+	})
+	if err != nil {
+		scrapeErrorsCounter.WithLabelValues(metricGroupMembers).Inc()
+		slog.Error("Failed to get guild roles", "guild", serverID, "error", err)
+		return
+	}
+
+	holders := make(map[string]int)
+	for _, member := range members {
+		for _, roleID := range member.Roles {
+			holders[roleID]++
+		}
+	}
+	counts := make(map[string]int, len(roles))
+	for _, role := range roles {
+		// @everyone のロール ID はギルド ID と同じで、全メンバーが持っている
+		if role.ID == serverID {
+			continue
+		}
+		counts[role.Name] += holders[role.ID]
+	}
+
+	for name := range roleLabels[serverID] {
+		if _, ok := counts[name]; !ok {
+			membersByRoleGauge.DeleteLabelValues(serverID, name)
+		}
+	}
+	labels := make(map[string]bool, len(counts))
+	for name, count := range counts {
+		membersByRoleGauge.WithLabelValues(serverID, name).Set(float64(count))
+		labels[name] = true
+	}
+	roleLabels[serverID] = labels
+}
+
+// fetchApproximateMemberCount sets discord_members_count from Discord's
+// approximate member count after the member list of the guild couldn't be
+// fetched with listErr, e.g. without the Server Members intent. The series only
+// the member list provides, the exact count and the counts by type, role and
+// flag, are deleted rather than left at their last values. It reports false if the
+// guild can't be fetched either.
+func fetchApproximateMemberCount(ctx context.Context, discordSession discordClient, serverID string, listErr error) (int, bool) {
+	guild, err := withRetry(ctx, "get guild with counts", func() (*discordgo.Guild, error) {
+		apiRequestsCounter.WithLabelValues("GuildWithCounts").Inc()
+		return discordSession.GuildWithCounts(serverID, discordgo.WithContext(ctx))
+	})
+	if err != nil {
+		scrapeErrorsCounter.WithLabelValues(metricGroupMembers).Inc()
+		slog.Error("Failed to get guild members", "guild", serverID, "error", listErr, "fallback_error", err)
+		return 0, false
+	}
+	memberCountGauge.DeleteLabelValues(serverID, "exact")
+	membersByTypeGauge.DeletePartialMatch(prometheus.Labels{"guild": serverID})
+	membersByRoleGauge.DeletePartialMatch(prometheus.Labels{"guild": serverID})
+	membersWithFlagGauge.DeletePartialMatch(prometheus.Labels{"guild": serverID})
+	delete(roleLabels, serverID)
+	memberCountGauge.WithLabelValues(serverID, "approximate").Set(float64(guild.ApproximateMemberCount))
+	slog.Warn("Failed to get guild members, using the approximate member count", "guild", serverID, "count", guild.ApproximateMemberCount, "source", "approximate", "error", listErr)
+	return guild.ApproximateMemberCount, true
+}
+
+// fetchAllMembers pages through GuildMembers, which returns at most
+// maxMembersPerRequest members per call, ordered by user ID.
+func fetchAllMembers(ctx context.Context, discordSession discordClient, serverID string) ([]*discordgo.Member, error) {
+	var members []*discordgo.Member
+	after := ""
+	for {
+		page, err := withRetry(ctx, "get guild members", func() ([]*discordgo.Member, error) {
+			apiRequestsCounter.WithLabelValues("GuildMembers").Inc()
+			return discordSession.GuildMembers(serverID, after, maxMembersPerRequest, discordgo.WithContext(ctx))
+		})
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(page) < maxMembersPerRequest {
+			return members, nil
+		}
+		after = page[len(page)-1].User.ID
+	}
+}
+
+// disambiguateChannelNames gives channels that share a name distinct names, so
+// that their series labelled only by channel name don't overwrite each other.
+// The oldest channel keeps its name and the others get their ID appended, e.g.
+// "general (123456789012345678)", or "general_123456789012345678" with
+// normalizeChannelLabels. Renamed channels are returned as copies.
+func disambiguateChannelNames(channels []*discordgo.Channel) []*discordgo.Channel {
+	oldest := make(map[string]*discordgo.Channel, len(channels))
+	for _, channel := range channels {
+		if first, ok := oldest[channel.Name]; !ok || newerSnowflake(first.ID, channel.ID) {
+			oldest[channel.Name] = channel
+		}
+	}
+
+	result := make([]*discordgo.Channel, 0, len(channels))
+	for _, channel := range channels {
+		if first := oldest[channel.Name]; first.ID != channel.ID {
+			renamed := *channel
+			renamed.Name = fmt.Sprintf("%s (%s)", channel.Name, channel.ID)
+			if config.NormalizeChannelLabels {
+				renamed.Name = channel.Name + "_" + channel.ID
+			}
+			slog.Warn("Channel name is not unique, labelling it with its ID", "channel", channel.Name, "channel_id", channel.ID, "label", renamed.Name)
+			channel = &renamed
+		}
+		result = append(result, channel)
+	}
+	return result
+}
+
+// isCountedChannel reports whether the messages of the channel are counted:
+// it is listed in includeChannels, or that is empty, and it isn't excluded.
+// The guilds block of the channel's guild may replace includeChannels.
+func isCountedChannel(channel *discordgo.Channel) bool {
+	configMu.RLock()
+	includedChannels, _ := channelFilters(channel.GuildID)
+	included := len(includedChannels) == 0
+	if !included {
+		_, byName := includedChannels[channel.Name]
+		_, byID := includedChannels[channel.ID]
+		included = byName || byID
+	}
+	configMu.RUnlock()
+	return included && !isExcludedChannel(channel)
+}
+
+// channelFilters returns the includeChannels and excludeChannels entries that
+// apply to the channels of the guild: those of its guilds block, or the global
+// ones where the block leaves them out. The caller holds configMu.
+func channelFilters(serverID string) (included, excluded map[string]struct{}) {
+	included, excluded = config.IncludedChannels, config.ExcludedChannels
+	if guild, ok := config.Guilds[serverID]; ok {
+		if guild.IncludedChannels != nil {
+			included = guild.IncludedChannels
+		}
+		if guild.ExcludedChannels != nil {
+			excluded = guild.ExcludedChannels
+		}
+	}
+	return included, excluded
+}
+
+// filterScope is a set of channel filter entries and the channels they apply
+// to: the global entries and the channels of the guilds without entries of
+// their own, or the entries of a guilds block and the channels of its guild.
+type filterScope struct {
+	// serverID is empty for the global entries.
+	serverID string
+	entries  map[string]struct{}
+	channels []*discordgo.Channel
+}
+
+// filterScopes splits the channels of the listed guilds into the scopes of
+// the global entries and of the guilds blocks whose entries, as returned by
+// blockEntries, replace them. The global scope is left out when every listed
+// guild replaces them. The caller holds configMu.
+func filterScopes(channels []*discordgo.Channel, listedGuilds map[string]bool, global map[string]struct{}, blockEntries func(*GuildConfig) map[string]struct{}) []filterScope {
+	usesGlobal := false
+	blockScopes := make(map[string]*filterScope)
+	for serverID := range listedGuilds {
+		if guild, ok := config.Guilds[serverID]; ok && blockEntries(guild) != nil {
+			blockScopes[serverID] = &filterScope{serverID: serverID, entries: blockEntries(guild)}
+		} else {
+			usesGlobal = true
+		}
+	}
+	globalScope := filterScope{entries: global}
+	for _, channel := range channels {
+		if scope, ok := blockScopes[channel.GuildID]; ok {
+			scope.channels = append(scope.channels, channel)
+		} else {
+			globalScope.channels = append(globalScope.channels, channel)
+		}
+	}
+
+	var scopes []filterScope
+	if usesGlobal {
+		scopes = append(scopes, globalScope)
+	}
+	for _, serverID := range config.ServerIDs {
+		if scope, ok := blockScopes[serverID]; ok {
+			scopes = append(scopes, *scope)
+		}
+	}
+	return scopes
+}
+
+// warnUnmatchedIncludes logs the includeChannels entries that are neither the
+// name nor the ID of any of the channels they apply to, which is most likely a
+// typo.
+func warnUnmatchedIncludes(channels []*discordgo.Channel, listedGuilds map[string]bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	scopes := filterScopes(channels, listedGuilds, config.IncludedChannels, func(guild *GuildConfig) map[string]struct{} {
+		return guild.IncludedChannels
+	})
+	for _, scope := range scopes {
+		for entry := range scope.entries {
+			if !slices.ContainsFunc(scope.channels, func(channel *discordgo.Channel) bool {
+				return channel.Name == entry || channel.ID == entry
+			}) {
+				if scope.serverID == "" {
+					slog.Warn("Included channel not found", "channel", entry)
+				} else {
+					slog.Warn("Included channel not found", "channel", entry, "guild", scope.serverID)
+				}
+			}
+		}
+	}
+}
+
+// countUnmatchedExcludes returns the number of excludeChannels and
+// excludeChannelIDs entries that are neither the name nor the ID of any of the
+// channels they apply to. Unlike unmatched includes they aren't logged, since
+// the default excludeChannels are missing from most servers.
+func countUnmatchedExcludes(channels []*discordgo.Channel, listedGuilds map[string]bool) int {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	unmatched := 0
+	scopes := filterScopes(channels, listedGuilds, config.ExcludedChannels, func(guild *GuildConfig) map[string]struct{} {
+		return guild.ExcludedChannels
+	})
+	for _, scope := range scopes {
+		for entry := range scope.entries {
+			if !slices.ContainsFunc(scope.channels, func(channel *discordgo.Channel) bool {
+				name := channel.Name
+				if config.ExcludeCaseInsensitive {
+					name = strings.ToLower(name)
+				}
+				return name == entry
+			}) {
+				slog.Debug("Excluded channel not found", "channel", entry)
+				unmatched++
+			}
+		}
+	}
+	for entry := range config.ExcludedChannelIDs {
+		if !slices.ContainsFunc(channels, func(channel *discordgo.Channel) bool {
+			return channel.ID == entry
+		}) {
+			slog.Debug("Excluded channel ID not found", "channel_id", entry)
+			unmatched++
+		}
+	}
+	return unmatched
+}
+
+// isExcludedChannel reports whether the channel's name or ID is excluded, or
+// its name matches one of the excludeChannelsRegex patterns. The guilds block
+// of the channel's guild may replace excludeChannels.
+func isExcludedChannel(channel *discordgo.Channel) bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	name := channel.Name
+	if config.ExcludeCaseInsensitive {
+		name = strings.ToLower(name)
+	}
+	_, excludedChannels := channelFilters(channel.GuildID)
+	if _, excluded := excludedChannels[name]; excluded {
+		return true
+	}
+	if _, excluded := config.ExcludedChannelIDs[channel.ID]; excluded {
+		return true
+	}
+	for _, re := range config.ExcludedChannelPatterns {
+		if re.MatchString(channel.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dueGuilds returns the guilds whose messages are counted in a cycle starting
+// at now: those without an interval in their guilds block, and those whose
+// interval has passed since their channels were last listed. A tenth of the
+// interval is allowed as slack, so that a guild whose interval is a multiple of
+// updateInterval isn't put off by a whole cycle when a tick comes early.
+func dueGuilds(serverIDs []string, now time.Time) []string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	var due []string
+	for _, serverID := range serverIDs {
+		guild, ok := config.Guilds[serverID]
+		last, counted := lastGuildCounts[serverID]
+		if !ok || guild.Interval == 0 || !counted || now.Sub(last) >= guild.Interval-guild.Interval/10 {
+			due = append(due, serverID)
+		}
+	}
+	return due
+}
+
+// updateMessageCount counts the channels of the guilds in one pass, usually
+// those returned by dueGuilds. It returns the results of the channels that were
+// counted successfully, and whether every guild's channels could be listed and
+// every channel was counted.
+func updateMessageCount(ctx context.Context, discordSession discordClient, serverIDs []string) ([]channelResult, bool) {
+	// どのギルドもまだ間隔が経っていない
+	if len(serverIDs) == 0 {
+		return nil, true
+	}
+	channelsProcessedGauge.Set(0)
+	var channels []*discordgo.Channel
+	listedGuilds := make(map[string]bool, len(serverIDs))
+	for _, serverID := range serverIDs {
+		guildChannels, err := withRetry(ctx, "get guild channels", func() ([]*discordgo.Channel, error) {
+			apiRequestsCounter.WithLabelValues("GuildChannels").Inc()
+			return discordSession.GuildChannels(serverID, discordgo.WithContext(ctx))
+		})
+		if err != nil {
+			scrapeErrorsCounter.WithLabelValues(metricGroupMessages).Inc()
+			slog.Error("Failed to get guild channels", "guild", serverID, "error", err)
+			continue
+		}
+		channels = append(channels, guildChannels...)
+		listedGuilds[serverID] = true
+		lastGuildCounts[serverID] = time.Now()
+
+		botJoinedAt[serverID] = lookupBotJoinedAt(ctx, discordSession, serverID)
+	}
+	// チャンネル一覧が取れなかったギルドの系列は前回の値のまま残る
+	scrapeUpGauge.WithLabelValues(metricGroupMessages).Set(boolToFloat(len(listedGuilds) == len(serverIDs)))
+	if len(listedGuilds) == 0 {
+		return nil, false
+	}
+	if config.CountRoleID != "" {
+		countRoleHolders = fetchCountRoleHolders(ctx, discordSession, serverIDs)
+	}
+
+	var textChannels, activeChannels []*discordgo.Channel
+	currentChannels := make(map[string]*discordgo.Channel)
+	threadParents := make(map[string]*discordgo.Channel)
+	categoryNames := make(map[string]string)
+	var listedThreads []*discordgo.Channel
+	excluded := make(map[string]int, len(listedGuilds))
+	categories := make(map[string]int, len(listedGuilds))
+	for serverID := range listedGuilds {
+		excluded[serverID] = 0
+		categories[serverID] = 0
+	}
+	for _, channel := range channels {
+		if channel.Type == discordgo.ChannelTypeGuildCategory {
+			categoryNames[channel.ID] = channel.Name
+			categories[channel.GuildID]++
+		}
+		// スレッドは includeThreads のときだけ、除外とは別に扱う
+		if channel.IsThread() {
+			listedThreads = append(listedThreads, channel)
+			continue
+		}
+		// フォーラム自体にはメッセージがないので、スレッドの親としてだけ扱う
+		if channel.Type == discordgo.ChannelTypeGuildForum && isCountedChannel(channel) {
+			threadParents[channel.ID] = channel
+			continue
+		}
+		if channel.Type != discordgo.ChannelTypeGuildText {
+			continue
+		}
+		if isExcludedChannel(channel) {
+			excluded[channel.GuildID]++
+		}
+		// includeChannels にない、または除外リストに含まれている場合、次のチャンネルへ
+		if !isCountedChannel(channel) {
+			continue
+		}
+		textChannels = append(textChannels, channel)
+	}
+	warnUnmatchedIncludes(channels, listedGuilds)
+	for serverID, count := range excluded {
+		channelsExcludedGauge.WithLabelValues(serverID).Set(float64(count))
+	}
+	for serverID, count := range categories {
+		categoryCountGauge.WithLabelValues(serverID).Set(float64(count))
+	}
+	// 一覧が取れなかった、または今回数えないギルドのチャンネルに当たる項目まで数えてしまうので、全ギルド取れたときだけ更新する
+	if len(listedGuilds) == len(config.ServerIDs) {
+		channelsExcludedUnmatchedGauge.Set(float64(countUnmatchedExcludes(channels, listedGuilds)))
+	}
+
+	var displayNames map[string]string
+	if config.NormalizeChannelLabels {
+		textChannels, displayNames = normalizeChannelNames(textChannels)
+	}
+	for serverID := range listedGuilds {
+		guildTextChannels[serverID] = nil
+	}
+	for _, channel := range textChannels {
+		guildTextChannels[channel.GuildID] = append(guildTextChannels[channel.GuildID], channel)
+	}
+	// 今回一覧を取らなかったギルドのチャンネルとも名前を区別して、ラベルが毎サイクル変わらないようにする
+	named := slices.Clip(textChannels)
+	for serverID, guildChannels := range guildTextChannels {
+		if !listedGuilds[serverID] {
+			named = append(named, guildChannels...)
+		}
+	}
+	for _, channel := range disambiguateChannelNames(named) {
+		if !listedGuilds[channel.GuildID] {
+			continue
+		}
+		currentChannels[channel.ID] = channel
+		threadParents[channel.ID] = channel
+		if config.NormalizeChannelLabels {
+			// 表示名だけが変わった場合に古い系列を残さない
+			channelInfoGauge.DeletePartialMatch(prometheus.Labels{"channel": channel.Name})
+			channelInfoGauge.WithLabelValues(channel.Name, displayNames[channel.ID]).Set(1)
+		}
+		// 作成日時は ID の Snowflake に含まれているので API を呼ぶ必要はない
+		if createdAt, err := snowflakeTimestamp(channel.ID); err == nil {
+			channelCreatedTimestampGauge.WithLabelValues(channel.Name).Set(float64(createdAt.Unix()))
+		} else {
+			slog.Warn("Failed to parse the channel ID", "channel", channel.Name, "channel_id", channel.ID, "error", err)
+		}
+		if config.LastMessagePosition && channel.LastMessageID != "" {
+			if position, err := strconv.ParseUint(channel.LastMessageID, 10, 64); err == nil {
+				lastMessagePositionGauge.WithLabelValues(channel.Name).Set(float64(position))
+			}
+		}
+		if skipOpenCircuit(channel) {
+			continue
+		}
+		activeChannels = append(activeChannels, channel)
+	}
+
+	threadsListed := true
+	if config.IncludeThreads {
+		var threads []*discordgo.Channel
+		threads, threadsListed = listActiveThreads(ctx, discordSession, listedGuilds, threadParents, listedThreads)
+		for _, thread := range threads {
+			currentChannels[thread.ID] = thread
+			if !skipOpenCircuit(thread) {
+				activeChannels = append(activeChannels, thread)
+			}
+		}
+	}
+	forgetRemovedChannels(currentChannels, listedGuilds)
+
+	// 前回のメッセージ数が多いチャンネルから処理して、サイクル全体の時間を短くする
+	estimate := func(channel *discordgo.Channel) int {
+		if total, ok := lastChannelTotals[channel.ID]; ok {
+			return total
+		}
+		return peerTotals[channel.Name]
+	}
+	sort.SliceStable(activeChannels, func(i, j int) bool {
+		return estimate(activeChannels[i]) > estimate(activeChannels[j])
 	})
-	messageCountGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "discord_message_count",
-			Help: "Number of messages per channel",
-		},
-		[]string{"channel"},
-	)
-)
 
-func init() {
-	viper.SetConfigName("discord-exporter")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
+	start := time.Now()
+	channelsTotalGauge.Set(float64(len(activeChannels)))
+	results := make(chan channelResult, len(activeChannels))
+	var wg sync.WaitGroup
+
+	for _, channel := range activeChannels {
+		channelWorkers.acquire()
+		// 空きを待っている間に打ち切られたら、残りのチャンネルは始めない
+		if ctx.Err() != nil {
+			channelWorkers.release()
+			break
+		}
+		wg.Add(1)
+		var cursor *channelStats
+		if stats, ok := channelCursors[channel.ID]; ok {
+			cursor = &stats
+		} else if seed, ok := peerSeeds[channel.ID]; ok {
+			stats := seedCursor(channel, seed)
+			cursor = &stats
+		}
+		go func(channel *discordgo.Channel) {
+			defer wg.Done()
+			defer channelWorkers.release()
+			defer channelsProcessedGauge.Inc()
+			// 1つのチャンネルで panic しても他のチャンネルの集計は続ける
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Recovered from panic while counting channel", "channel", channel.Name, "channel_id", channel.ID, "panic", r)
+					results <- channelResult{channel: channel, err: fmt.Errorf("panic: %v", r)}
+				}
+			}()
+			results <- processChannel(ctx, discordSession, channel, cursor)
+		}(channel)
+	}
+
+	wg.Wait()
+	close(results)
+
+	successCount, errorCount := 0, 0
+	noAccess := make(map[string]int, len(listedGuilds))
+	guildTotals := make(map[string]int, len(listedGuilds))
+	guildAttachments := make(map[string]int, len(listedGuilds))
+	guildEmbeds := make(map[string]int, len(listedGuilds))
+	for serverID := range listedGuilds {
+		noAccess[serverID] = 0
+		guildTotals[serverID] = 0
+		guildAttachments[serverID] = 0
+		guildEmbeds[serverID] = 0
+	}
+	var totals []int
+	var ageCount uint64
+	var ageSum float64
+	ageBuckets := make(map[float64]uint64, len(config.MessageAgeBuckets))
+	for _, bound := range config.MessageAgeBuckets {
+		ageBuckets[bound] = 0
+	}
+	var counted []channelResult
+	for result := range results {
+		// 読めないチャンネルは権限の問題なので、エラーにもサーキットブレーカーにも数えない
+		if isForbidden(result.err) {
+			noAccess[result.channel.GuildID]++
+			if !noAccessLogged[result.channel.ID] {
+				slog.Info("No access to channel, skipping it", "channel", result.channel.Name, "channel_id", result.channel.ID)
+				noAccessLogged[result.channel.ID] = true
+			}
+			continue
+		}
+		delete(noAccessLogged, result.channel.ID)
+		// 打ち切られたチャンネルはエラーやサーキットブレーカーに数えず、前回の値のまま残す
+		if result.err != nil && ctx.Err() != nil {
+			continue
+		}
+		if result.err != nil {
+			if config.OnChannelError == onChannelErrorClear {
+				clearChannelSeries(result.channel)
+				slog.Error("Failed to get messages, cleared the channel's series", "channel", result.channel.Name, "channel_id", result.channel.ID, "error", result.err)
+			} else {
+				slog.Error("Failed to get messages, keeping the channel's previous values", "channel", result.channel.Name, "channel_id", result.channel.ID, "error", result.err)
+			}
+			scrapeErrorsCounter.WithLabelValues(metricGroupMessages).Inc()
+			recordChannelFailure(result.channel)
+			errorCount++
+			continue
+		}
+		delete(channelBreakers, result.channel.ID)
+		lastChannelTotals[result.channel.ID] = result.stats.messages
+		if config.IncrementalCount {
+			channelCursors[result.channel.ID] = result.stats
+			delete(peerSeeds, result.channel.ID)
+		}
+		successCount++
+		if config.MessageAgeHistogram {
+			ageCount += uint64(result.stats.messages)
+			ageSum += result.stats.ageSum
+			for i, bound := range config.MessageAgeBuckets {
+				ageBuckets[bound] += result.stats.ageBuckets[i]
+			}
+		}
+		if result.channel.IsThread() {
+			parentName := ""
+			if parent, ok := threadParents[result.channel.ParentID]; ok {
+				parentName = parent.Name
+			}
+			threadMessageCountGauge.WithLabelValues(parentName, result.channel.Name, result.channel.ID).Set(float64(result.stats.messages))
+			continue
+		}
+		circuitOpenGauge.WithLabelValues(result.channel.Name).Set(0)
+
+		// カテゴリ名は毎サイクル引き直すので、移動や名前変更にも追従する
+		category := categoryNames[result.channel.ParentID]
+		if previous, ok := channelCategories[result.channel.ID]; ok && previous != category {
+			messageCountGauge.DeletePartialMatch(prometheus.Labels{"channel_id": result.channel.ID, "category": previous})
+			recentMessageCountGauge.DeletePartialMatch(prometheus.Labels{"channel_id": result.channel.ID, "category": previous})
+		}
+		channelCategories[result.channel.ID] = category
+		switch {
+		case !config.EmitPerChannelMessages:
+		case config.MessageLookback > 0:
+			recentMessageCountGauge.WithLabelValues(result.channel.GuildID, result.channel.Name, result.channel.ID, category).Set(float64(result.stats.messages))
+		default:
+			messageCountGauge.WithLabelValues(result.channel.GuildID, result.channel.Name, result.channel.ID, category).Set(float64(result.stats.messages))
+		}
+		if !botJoinedAt[result.channel.GuildID].IsZero() {
+			observedMessageCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.observed))
+		}
+		updateLastMessageTimestamp(result.channel, result.stats.newestID)
+		if config.CountReactions {
+			perMessage := 0.0
+			if result.stats.messages > 0 {
+				perMessage = float64(result.stats.reactions) / float64(result.stats.messages)
+			}
+			reactionsPerMessageGauge.WithLabelValues(result.channel.Name).Set(perMessage)
+			reactionCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.reactions))
+		}
+		if config.CountEmoji {
+			emojiUsedCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.emoji))
+		}
+		if config.CountMentions {
+			mentionsCountGauge.WithLabelValues(result.channel.Name, "user").Set(float64(result.stats.userMentions))
+			mentionsCountGauge.WithLabelValues(result.channel.Name, "role").Set(float64(result.stats.roleMentions))
+			mentionsCountGauge.WithLabelValues(result.channel.Name, "everyone").Set(float64(result.stats.everyoneMentions))
+		}
+		if config.CountOrphanedReplies {
+			orphanedRepliesGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.orphanedReplies))
+		}
+		if config.CountEdited {
+			editedMessagesGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.edited))
+		}
+		if config.TopTalkers > 0 {
+			updateTopTalkers(result.channel, result.stats.authors, result.stats.authorNames)
+		}
+		if config.TopReactionEmoji > 0 {
+			updateTopReactionEmoji(result.channel, result.stats.reactionEmoji)
+		}
+		if config.MessagesPerDay > 0 {
+			updateMessagesPerDay(result.channel, result.stats.days, time.Now())
+		}
+		if countRoleHolders != nil {
+			roleMessageCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.roleMessages))
+		}
+		if config.CountAuthorTypes {
+			messagesByAuthorTypeGauge.WithLabelValues(result.channel.Name, "human").Set(float64(result.stats.messages - result.stats.botMessages))
+			messagesByAuthorTypeGauge.WithLabelValues(result.channel.Name, "bot").Set(float64(result.stats.botMessages))
+		}
+		if config.MaxMessagePagesPerChannel > 0 {
+			capped := 0.0
+			if result.stats.capped {
+				capped = 1
+			}
+			messageCountCappedGauge.WithLabelValues(result.channel.Name).Set(capped)
+		}
+		if config.CountPinned {
+			pinnedMessageCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.pinned))
+		}
+		if config.CountAttachments {
+			guildAttachments[result.channel.GuildID] += result.stats.attachments
+			guildEmbeds[result.channel.GuildID] += result.stats.embeds
+		}
+		if config.CountAttachments && config.EmitPerChannelAttachments {
+			attachmentCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.attachments))
+			embedCountGauge.WithLabelValues(result.channel.Name).Set(float64(result.stats.embeds))
+		}
+		for i, re := range config.KeywordPatterns {
+			keywordMessageCountGauge.WithLabelValues(result.channel.Name, re.String()).Set(float64(result.stats.keywords[i]))
+		}
+		totals = append(totals, result.stats.messages)
+		guildTotals[result.channel.GuildID] += result.stats.messages
+		counted = append(counted, result)
+		updateChannelTrend(result.channel, result.stats.messages, time.Now())
+	}
+
+	if err := ctx.Err(); err != nil {
+		// 一部のチャンネルしか数えていないので、合計や分布は前回の値のまま残す
+		slog.Warn("Message count aborted, keeping the values of the channels counted so far", "succeeded", successCount, "failed", errorCount, "error", err)
+		return counted, false
+	}
+
+	// 間隔が経っていないギルドのチャンネルは前回の件数で分布に含める
+	countedGuilds := make(map[string]bool, len(serverIDs))
+	for _, serverID := range serverIDs {
+		countedGuilds[serverID] = true
+	}
+	for id, channel := range knownChannels {
+		if total, ok := lastChannelTotals[id]; ok && !countedGuilds[channel.GuildID] && !channel.IsThread() {
+			totals = append(totals, total)
+		}
+	}
+	messageCountDistribution.set(config.MessageCountBuckets, totals)
+	for serverID, count := range noAccess {
+		channelsNoAccessGauge.WithLabelValues(serverID).Set(float64(count))
+	}
+	for serverID, total := range guildTotals {
+		messageCountTotalGauge.WithLabelValues(serverID).Set(float64(total))
+	}
+	if config.CountAttachments {
+		for serverID, total := range guildAttachments {
+			attachmentCountTotalGauge.WithLabelValues(serverID).Set(float64(total))
+			embedCountTotalGauge.WithLabelValues(serverID).Set(float64(guildEmbeds[serverID]))
+		}
+	}
+	if config.MessageAgeHistogram {
+		messageAgeHistogram.setCounts(ageCount, ageSum, ageBuckets)
+	}
+
+	elapsed := time.Since(start)
+	messageScrapeDurationGauge.Set(elapsed.Seconds())
+	if elapsed > 0 {
+		channelsPerSecondGauge.Set(float64(successCount) / elapsed.Seconds())
+	}
+	slog.Info("Message count updated", "succeeded", successCount, "failed", errorCount, "duration", elapsed)
+	return counted, len(listedGuilds) == len(serverIDs) && threadsListed && errorCount == 0
+}
+
+// checkBotAccount refuses to run with a token that authenticates as a user
+// account. Automating user accounts (self-botting) violates Discord's Terms of
+// Service, so only bot tokens are supported.
+func checkBotAccount(discordSession discordClient) error {
+	user, err := withRetry(context.Background(), "get bot user", func() (*discordgo.User, error) {
+		apiRequestsCounter.WithLabelValues("User").Inc()
+		return discordSession.User("@me")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with the token: %w", err)
+	}
+	if !user.Bot {
+		return fmt.Errorf("token authenticates as user %s, only bot tokens are supported", user.Username)
+	}
+	return nil
+}
+
+// newDiscordTransport returns the transport of the Discord API client. It goes
+// through httpProxy if configured, and otherwise honors HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY like http.DefaultTransport.
+func newDiscordTransport(config *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.HTTPProxy != nil {
+		transport.Proxy = http.ProxyURL(config.HTTPProxy)
+	}
+	return transport
+}
+
+// checkServerAccess verifies that the bot can list the channels of every
+// server. With the members group enabled it also tries to list their members,
+// which needs the Server Members intent, and warns that the approximate member
+// count is used if that fails.
+func checkServerAccess(discordSession discordClient, serverIDs []string) error {
+	ctx := context.Background()
+	for _, serverID := range serverIDs {
+		_, err := withRetry(ctx, "get guild channels", func() ([]*discordgo.Channel, error) {
+			apiRequestsCounter.WithLabelValues("GuildChannels").Inc()
+			return discordSession.GuildChannels(serverID)
+		})
+		if err != nil {
+			return fmt.Errorf("can't access server %s, check that the bot is a member: %w", serverID, err)
+		}
+		if !config.MetricEnabled(metricGroupMembers) {
+			continue
+		}
+		_, err = withRetry(ctx, "get guild members", func() ([]*discordgo.Member, error) {
+			apiRequestsCounter.WithLabelValues("GuildMembers").Inc()
+			return discordSession.GuildMembers(serverID, "", 1)
+		})
+		if err != nil {
+			slog.Warn("Can't list the members of the server, check that the Server Members intent is enabled. Falling back to the approximate member count", "guild", serverID, "error", err)
+		}
+	}
+	return nil
+}
+
+// detectServerID returns the only guild the bot is a member of, for when
+// serverID is not configured.
+func detectServerID(discordSession discordClient) (string, error) {
+	guilds, err := withRetry(context.Background(), "list the bot's servers", func() ([]*discordgo.UserGuild, error) {
+		apiRequestsCounter.WithLabelValues("UserGuilds").Inc()
+		return discordSession.UserGuilds(2, "", "")
+	})
 	if err != nil {
-		log.Fatalf("Error reading config file, %s", err)
+		return "", fmt.Errorf("no serverID provided and failed to list the bot's servers: %w", err)
 	}
+	switch len(guilds) {
+	case 0:
+		return "", fmt.Errorf("no serverID provided and the bot is not a member of any server")
+	case 1:
+		slog.Info("No serverID provided, using the bot's only server", "name", guilds[0].Name, "guild", guilds[0].ID)
+		return guilds[0].ID, nil
+	default:
+		return "", fmt.Errorf("no serverID provided and the bot is a member of several servers, set serverID")
+	}
+}
 
-	prometheus.MustRegister(memberCountGauge)
-	prometheus.MustRegister(messageCountGauge)
+// warmStart seeds discord_message_count of the channels of serverIDs from a
+// peer exporter, so that per-channel totals are served right after a restart
+// instead of only once the first full scan has finished. With incrementalCount
+// the seeded totals are also the baselines the first cycle continues from,
+// see seedCursor. Nothing is seeded with messageLookback, whose counts aren't
+// discord_message_count, or without emitPerChannelMessages. If the peer is
+// unavailable, the exporter starts empty as usual.
+func warmStart(peerURL string, serverIDs []string) {
+	channels, err := fetchPeerTotals(peerURL, config.MetricPrefix())
+	if err != nil {
+		slog.Warn("Failed to bootstrap message counts, starting with a full scan", "peer", peerURL, "error", err)
+		return
+	}
+	peerTotals = make(map[string]int, len(channels))
+	peerSeeds = make(map[string]peerChannel)
+	seed := config.MessageLookback == 0 && config.EmitPerChannelMessages
+	seeded := 0
+	for _, channel := range channels {
+		peerTotals[channel.name] = channel.total
+		// 古いピアの系列は guild や channel_id がないので、スケジューリングにだけ使う
+		if !seed || channel.guild == "" || channel.channelID == "" || !slices.Contains(serverIDs, channel.guild) {
+			continue
+		}
+		messageCountGauge.WithLabelValues(channel.guild, channel.name, channel.channelID, channel.category).Set(float64(channel.total))
+		channelCategories[channel.channelID] = channel.category
+		// 最初のサイクルで消えたチャンネルの系列を消せるように登録しておく
+		knownChannels[channel.channelID] = &discordgo.Channel{ID: channel.channelID, GuildID: channel.guild, Name: channel.name}
+		if config.IncrementalCount && !channel.newestAt.IsZero() {
+			peerSeeds[channel.channelID] = channel
+		}
+		seeded++
+	}
+	slog.Info("Bootstrapped message counts", "channels", len(channels), "seeded", seeded, "peer", peerURL)
 }
 
-func updateMemberCount(discordSession *discordgo.Session, serverID string) {
-	members, err := discordSession.GuildMembers(serverID, "", 1000)
+func lookupBotJoinedAt(ctx context.Context, discordSession discordClient, serverID string) time.Time {
+	bot, err := withRetry(ctx, "get bot user", func() (*discordgo.User, error) {
+		apiRequestsCounter.WithLabelValues("User").Inc()
+		return discordSession.User("@me", discordgo.WithContext(ctx))
+	})
+	if err != nil {
+		slog.Error("Failed to get bot user", "error", err)
+		return time.Time{}
+	}
+	member, err := withRetry(ctx, "get bot guild member", func() (*discordgo.Member, error) {
+		apiRequestsCounter.WithLabelValues("GuildMember").Inc()
+		return discordSession.GuildMember(serverID, bot.ID, discordgo.WithContext(ctx))
+	})
 	if err != nil {
-		log.Fatalf("Failed to get guild members: %v", err)
+		slog.Error("Failed to get bot guild member", "guild", serverID, "error", err)
+		return time.Time{}
+	}
+	return member.JoinedAt
+}
+
+// skipOpenCircuit reports whether the channel is skipped this cycle because its
+// circuit breaker is open, and counts the skipped cycle.
+func skipOpenCircuit(channel *discordgo.Channel) bool {
+	breaker, ok := channelBreakers[channel.ID]
+	if !ok || breaker.skipCycles == 0 {
+		return false
+	}
+	breaker.skipCycles--
+	return true
+}
+
+func recordChannelFailure(channel *discordgo.Channel) {
+	breaker, ok := channelBreakers[channel.ID]
+	if !ok {
+		breaker = &channelBreaker{}
+		channelBreakers[channel.ID] = breaker
+	}
+	breaker.failures++
+	if breaker.failures < circuitBreakerThreshold {
 		return
 	}
 
-	memberCount := len(members)
-	memberCountGauge.Set(float64(memberCount))
-	log.Printf("Member count: %v", float64(memberCount))
+	shift := min(breaker.failures-circuitBreakerThreshold, 5)
+	breaker.skipCycles = min(1<<shift, maxCircuitBreakerBackoff)
+	if !channel.IsThread() {
+		circuitOpenGauge.WithLabelValues(channel.Name).Set(1)
+	}
+	slog.Warn("Channel failed repeatedly, skipping it", "channel", channel.Name, "channel_id", channel.ID, "failures", breaker.failures, "skip_cycles", breaker.skipCycles)
+}
+
+// clearChannelSeries deletes the series of a channel that failed to count,
+// except discord_channel_circuit_open, which reports the failures.
+func clearChannelSeries(channel *discordgo.Channel) {
+	if channel.IsThread() {
+		threadMessageCountGauge.DeletePartialMatch(prometheus.Labels{"thread_id": channel.ID})
+		return
+	}
+	messageCountGauge.DeletePartialMatch(prometheus.Labels{"channel_id": channel.ID})
+	recentMessageCountGauge.DeletePartialMatch(prometheus.Labels{"channel_id": channel.ID})
+	delete(channelCategories, channel.ID)
+	for _, gauge := range channelGauges {
+		if gauge != circuitOpenGauge {
+			gauge.DeletePartialMatch(prometheus.Labels{"channel": channel.Name})
+		}
+	}
 }
 
-func updateMessageCount(discordSession *discordgo.Session, serverID string) {
-	channels, err := discordSession.GuildChannels(serverID)
+// updateLastMessageTimestamp sets discord_channel_last_message_timestamp_seconds
+// from the snowflake of the newest message counted, or of the channel's last
+// message when none was counted, e.g. beyond messageLookback. A channel without
+// messages has no series, so that it can't be mistaken for one that went
+// silent in 1970.
+func updateLastMessageTimestamp(channel *discordgo.Channel, newestID string) {
+	id := newestID
+	if id == "" {
+		id = channel.LastMessageID
+	}
+	at, err := snowflakeTimestamp(id)
 	if err != nil {
-		log.Fatalf("Failed to get guild channels: %v", err)
+		lastMessageTimestampGauge.DeleteLabelValues(channel.Name)
 		return
 	}
+	lastMessageTimestampGauge.WithLabelValues(channel.Name).Set(float64(at.Unix()))
+}
 
-	// 除外するチャンネル名のリスト
-	excludedChannels := map[string]struct{}{
-		"パダワン部屋": {},
-		"入室通知":   {},
-		// 他のチャンネル名を追加...
+// channelGauges are the gauges labelled by channel name, whose series are
+// deleted when the channel goes away.
+var channelGauges = []*prometheus.GaugeVec{
+	keywordMessageCountGauge,
+	messageRateGauge,
+	messagesLastIntervalGauge,
+	messageAccelerationGauge,
+	observedMessageCountGauge,
+	lastMessagePositionGauge,
+	lastMessageTimestampGauge,
+	channelCreatedTimestampGauge,
+	reactionsPerMessageGauge,
+	reactionCountGauge,
+	emojiUsedCountGauge,
+	mentionsCountGauge,
+	orphanedRepliesGauge,
+	editedMessagesGauge,
+	messagesByAuthorTypeGauge,
+	roleMessageCountGauge,
+	userMessageCountGauge,
+	emojiReactionCountGauge,
+	messagesPerDayGauge,
+	channelInfoGauge,
+	messageCountCappedGauge,
+	pinnedMessageCountGauge,
+	attachmentCountGauge,
+	embedCountGauge,
+	circuitOpenGauge,
+}
+
+// forgetRemovedChannels deletes the series and state of channels that had
+// series in the previous cycle but have since been deleted, excluded or
+// renamed. Channels of guilds whose channel list couldn't be fetched this cycle
+// are kept as they are.
+func forgetRemovedChannels(current map[string]*discordgo.Channel, listedGuilds map[string]bool) {
+	for id, previous := range knownChannels {
+		if !listedGuilds[previous.GuildID] {
+			current[id] = previous
+		}
+	}
+	names := make(map[string]bool, len(current))
+	for _, channel := range current {
+		if !channel.IsThread() {
+			names[channel.Name] = true
+		}
 	}
 
-	for _, channel := range channels {
-		// チャンネルが除外リストに含まれている場合、次のチャンネルへ
-		if _, excluded := excludedChannels[channel.Name]; excluded {
+	for id, previous := range knownChannels {
+		channel, ok := current[id]
+		if ok && channel.Name == previous.Name {
 			continue
 		}
+		if previous.IsThread() {
+			threadMessageCountGauge.DeletePartialMatch(prometheus.Labels{"thread_id": id})
+		}
+		messageCountGauge.DeletePartialMatch(prometheus.Labels{"channel_id": id})
+		recentMessageCountGauge.DeletePartialMatch(prometheus.Labels{"channel_id": id})
+		delete(channelCategories, id)
+		// 同じ名前のチャンネルがまだあれば、その系列は残す
+		if !previous.IsThread() && !names[previous.Name] {
+			for _, gauge := range channelGauges {
+				gauge.DeletePartialMatch(prometheus.Labels{"channel": previous.Name})
+			}
+		}
+		if !ok {
+			delete(lastChannelTotals, id)
+			delete(channelTrends, id)
+			delete(channelBreakers, id)
+			delete(channelCursors, id)
+			delete(peerSeeds, id)
+			slog.Info("Channel is gone or excluded, deleted its series", "channel", previous.Name, "channel_id", id)
+		}
+	}
+	knownChannels = current
+}
+
+// updateChannelTrend derives the message rate and the messages since the last
+// cycle from the previous observation of the channel, and the acceleration from
+// the previous rate. None is exported until there is enough history: the rate
+// and delta need two cycles, the acceleration three. A count that went down,
+// e.g. after deletions or as messages leave messageLookback, gives a delta of 0.
+func updateChannelTrend(channel *discordgo.Channel, messages int, now time.Time) {
+	trend := channelTrend{messages: messages, observedAt: now}
+
+	prev, ok := channelTrends[channel.ID]
+	if ok {
+		messagesLastIntervalGauge.WithLabelValues(channel.Name).Set(float64(max(messages-prev.messages, 0)))
+		if elapsed := now.Sub(prev.observedAt).Seconds(); elapsed > 0 {
+			trend.rate = float64(messages-prev.messages) / elapsed
+			trend.hasRate = true
+			messageRateGauge.WithLabelValues(channel.Name).Set(trend.rate)
+			if prev.hasRate {
+				messageAccelerationGauge.WithLabelValues(channel.Name).Set(trend.rate - prev.rate)
+			}
+		}
+	}
+
+	channelTrends[channel.ID] = trend
+}
+
+func processChannel(ctx context.Context, discordSession discordClient, channel *discordgo.Channel, cursor *channelStats) channelResult {
+	joinedAt := botJoinedAt[channel.GuildID]
+	var stats channelStats
+	var err error
+	if cursor != nil {
+		stats, err = countNewMessages(ctx, discordSession, channel, joinedAt, *cursor)
+	} else {
+		stats, err = countChannelMessages(ctx, discordSession, channel.ID, joinedAt, "")
+	}
+	// ピン留めは増分では追えないので毎回取得する
+	if err == nil && config.CountPinned && !channel.IsThread() {
+		stats.pinned, err = countPinnedMessages(ctx, discordSession, channel.ID)
+	}
+	return channelResult{channel: channel, stats: stats, err: err}
+}
 
-		var lastMessageID string
-		totalMessageCount := 0
+// countPinnedMessages returns the number of pinned messages in the channel,
+// which Discord returns in a single response.
+func countPinnedMessages(ctx context.Context, discordSession discordClient, channelID string) (int, error) {
+	pinned, err := withRetry(ctx, "get pinned messages", func() ([]*discordgo.Message, error) {
+		apiRequestsCounter.WithLabelValues("ChannelMessagesPinned").Inc()
+		return discordSession.ChannelMessagesPinned(channelID, discordgo.WithContext(ctx))
+	})
+	return len(pinned), err
+}
+
+// countChannelMessages pages through the channel from the newest message. With
+// messageLookback it stops at the first message older than the window, so
+// every tally only covers the window. When after is set, it only pages through
+// the messages newer than after instead.
+func countChannelMessages(ctx context.Context, discordSession discordClient, channelID string, joinedAt time.Time, after string) (channelStats, error) {
+	stats := channelStats{keywords: make([]int, len(config.KeywordPatterns))}
+	var lastMessageID string
+	if config.MessageAgeHistogram {
+		stats.ageBuckets = make([]uint64, len(config.MessageAgeBuckets))
+	}
+	if config.TopTalkers > 0 {
+		stats.authors = make(map[string]int)
+		stats.authorNames = make(map[string]string)
+	}
+	if config.TopReactionEmoji > 0 {
+		stats.reactionEmoji = make(map[string]int)
+	}
+	if config.MessagesPerDay > 0 {
+		stats.days = make(map[string]int)
+	}
+	now := time.Now()
+	var cutoff time.Time
+	if config.MessageLookback > 0 {
+		cutoff = time.Now().Add(-config.MessageLookback)
+	}
 
-		for {
-			messages, err := discordSession.ChannelMessages(channel.ID, 100, lastMessageID, "", "")
-			if err != nil {
-				log.Printf("Failed to get messages for channel %s: %v", channel.ID, err)
-				break
+	for page := 1; ; page++ {
+		messages, err := withRetry(ctx, "get channel messages", func() ([]*discordgo.Message, error) {
+			apiRequestsCounter.WithLabelValues("ChannelMessages").Inc()
+			if after != "" {
+				return discordSession.ChannelMessages(channelID, config.MessagePageSize, "", after, "", discordgo.WithContext(ctx))
 			}
+			return discordSession.ChannelMessages(channelID, config.MessagePageSize, lastMessageID, "", "", discordgo.WithContext(ctx))
+		})
+		if err != nil {
+			return stats, err
+		}
 
-			messageCount := len(messages)
-			totalMessageCount += messageCount
+		messageCount := len(messages)
 
-			if messageCount < 100 {
-				break
+		for _, message := range messages {
+			// 新しい順に返ってくるので、期間外のメッセージに達したら終わり
+			if !cutoff.IsZero() && message.Timestamp.Before(cutoff) {
+				return stats, nil
+			}
+			stats.messages++
+			if newerSnowflake(message.ID, stats.newestID) {
+				stats.newestID = message.ID
+			}
+			if !joinedAt.IsZero() && !message.Timestamp.Before(joinedAt) {
+				stats.observed++
+			}
+			if config.CountReactions {
+				for _, reaction := range message.Reactions {
+					stats.reactions += reaction.Count
+					// 標準の絵文字には ID がない
+					if config.TopReactionEmoji > 0 && reaction.Emoji != nil && (reaction.Emoji.ID != "" || !config.CustomEmojiOnly) {
+						stats.reactionEmoji[reactionEmojiName(reaction.Emoji)] += reaction.Count
+					}
+				}
+			}
+			if config.CountEmoji {
+				stats.emoji += countEmoji(message.Content)
+			}
+			if config.CountMentions {
+				stats.userMentions += len(message.Mentions)
+				stats.roleMentions += len(message.MentionRoles)
+				if message.MentionEveryone {
+					stats.everyoneMentions++
+				}
+			}
+			if config.CountEdited && message.EditedTimestamp != nil {
+				stats.edited++
+			}
+			if config.MessageAgeHistogram {
+				age := now.Sub(message.Timestamp).Seconds()
+				stats.ageSum += age
+				for i, bound := range config.MessageAgeBuckets {
+					if age <= bound {
+						stats.ageBuckets[i]++
+					}
+				}
 			}
+			// Webhook のメッセージも Bot として数える
+			if config.CountAuthorTypes && (message.WebhookID != "" || message.Author != nil && message.Author.Bot) {
+				stats.botMessages++
+			}
+			if config.TopTalkers > 0 && message.Author != nil {
+				// ユーザー名は変えられるので ID で数える
+				if _, seen := stats.authorNames[message.Author.ID]; !seen {
+					stats.authorNames[message.Author.ID] = message.Author.Username
+				}
+				stats.authors[message.Author.ID]++
+			}
+			if countRoleHolders != nil && message.Author != nil && countRoleHolders[message.Author.ID] {
+				stats.roleMessages++
+			}
+			if config.MessagesPerDay > 0 {
+				stats.days[messageDay(message)]++
+			}
+			if config.CountAttachments {
+				stats.attachments += len(message.Attachments)
+				stats.embeds += len(message.Embeds)
+			}
+			// 返信先が削除されている場合、Discord は referenced_message を null で返す
+			if config.CountOrphanedReplies && message.Type == discordgo.MessageTypeReply && message.ReferencedMessage == nil {
+				stats.orphanedReplies++
+			}
+			for i, re := range config.KeywordPatterns {
+				if re.MatchString(message.Content) {
+					stats.keywords[i]++
+				}
+			}
+		}
 
-			lastMessageID = messages[messageCount-1].ID
+		if messageCount < config.MessagePageSize {
+			return stats, nil
+		}
+		if config.MaxMessagePagesPerChannel > 0 && page >= config.MaxMessagePagesPerChannel {
+			slog.Info("Reached maxMessagePagesPerChannel, the message count is a lower bound", "channel_id", channelID, "pages", page, "messages", stats.messages)
+			stats.capped = true
+			return stats, nil
 		}
 
-		messageCountGauge.WithLabelValues(channel.Name).Set(float64(totalMessageCount))
+		lastMessageID = messages[messageCount-1].ID
+		if after != "" {
+			after = stats.newestID
+		}
 	}
-	log.Printf("Message count: %v", messageCountGauge)
 }
 
 func main() {
-	token := viper.GetString("token")
-	serverID = viper.GetString("serverID")
-
-	if token == "" {
-		log.Println("No Discord token provided")
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	if checkConfigOnly {
+		printConfig(os.Stdout)
+		os.Exit(0)
+	}
+	slog.SetDefault(newLogger(config))
+	watchConfig(*config)
+	slog.Info("Starting discord-exporter", "version", Version, "commit", Commit)
+	buildInfoGauge.WithLabelValues(Version, Commit, runtime.Version()).Set(1)
+	configLastReloadGauge.SetToCurrentTime()
+	// デフォルトレジストリと同じく Go ランタイムとプロセスのメトリクスも公開する
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if err := registerMetrics(registry, config); err != nil {
+		slog.Error("Failed to register metrics", "error", err)
 		os.Exit(1)
 	}
+	channelWorkers.resize(config.MaxConcurrentChannels)
 
-	if serverID == "" {
-		log.Println("No serverID provided")
+	session, err := discordgo.New("Bot " + config.Token)
+	if err != nil {
+		slog.Error("Failed to create Discord session", "error", err)
 		os.Exit(1)
 	}
 
-	var err error
-	discordSession, err = discordgo.New("Bot " + token)
+	session.Client = &http.Client{Timeout: config.HTTPTimeout, Transport: newDiscordTransport(config)}
+	if config.HTTPProxy != nil {
+		// ゲートウェイの WebSocket 接続も同じプロキシを通す
+		dialer := *websocket.DefaultDialer
+		dialer.Proxy = http.ProxyURL(config.HTTPProxy)
+		session.Dialer = &dialer
+	}
+	// 429 は withRetry で待ってから同じページを取り直す
+	session.ShouldRetryOnRateLimit = false
+	discordSession = session
+
+	if !config.SkipStartupCheck {
+		if err := checkBotAccount(discordSession); err != nil {
+			slog.Error("Invalid token", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(config.ServerIDs) == 0 {
+		serverID, err := detectServerID(discordSession)
+		if err != nil {
+			slog.Error("Failed to detect the server", "error", err)
+			os.Exit(1)
+		}
+		config.ServerIDs = []string{serverID}
+	}
+	serverIDs = config.ServerIDs
+
+	if listChannelsOnly {
+		if err := listChannels(os.Stdout, discordSession, serverIDs); err != nil {
+			slog.Error("Failed to list channels", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if config.SQLitePath != "" {
+		history, err = openHistoryStore(config.SQLitePath)
+		if err != nil {
+			slog.Error("Failed to open history", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.PeerURL != "" {
+		warmStart(config.PeerURL, serverIDs)
+	}
+
+	if !config.SkipStartupCheck {
+		if err := checkServerAccess(discordSession, serverIDs); err != nil {
+			slog.Error("Startup check failed", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if intents := gatewayIntents(config); intents != 0 {
+		session.Identify.Intents = intents
+		if err := session.Open(); err != nil {
+			slog.Error("Failed to open gateway connection", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.Mode == modePush {
+		err := pushOnce(ctx, registry)
+		session.Close()
+		if history != nil {
+			history.close()
+		}
+		if err != nil {
+			slog.Error("Failed to push metrics", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// ポートが使えないなら Discord から収集を始める前に終了する
+	ln, err := listenMetrics(config.MetricsPort)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Failed to serve metrics", "error", err)
+		os.Exit(1)
 	}
 
+	collectorDone := make(chan struct{})
+	if config.CollectOnScrape {
+		// スクレイプごとに discordCollector が収集する
+		close(collectorDone)
+	} else {
+		go func() {
+			defer close(collectorDone)
+			startMetricsCollector(ctx, discordSession, serverIDs)
+		}()
+	}
+
+	registerHandlers(ctx, config, registry)
+	srv := &http.Server{
+		Addr:         config.MetricsPort,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
 	go func() {
-		for {
-			updateMemberCount(discordSession, serverID)
-			updateMessageCount(discordSession, serverID)
-			time.Sleep(15 * time.Minute)
+		var err error
+		if config.TLSCertFile != "" {
+			err = srv.ServeTLS(ln, config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Failed to serve metrics", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":2112", nil)
+	<-ctx.Done()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down metrics server", "error", err)
+	}
+	// 実行中のサイクルが中断されるのをタイムアウトまで待つ
+	select {
+	case <-collectorDone:
+	case <-shutdownCtx.Done():
+		slog.Warn("Collection cycle did not finish within the shutdown timeout")
+	}
+	session.Close()
+	if history != nil {
+		history.close()
+	}
 }
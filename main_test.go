@@ -0,0 +1,1475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMain(m *testing.M) {
+	// 失敗や警告のログはテストの出力に混ぜない
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// setupTest installs a minimal valid config with the members and messages
+// groups and clears the state carried between cycles, so that every test
+// starts like a freshly started exporter. It returns the config so that the
+// test can adjust it.
+func setupTest(t *testing.T) *Config {
+	t.Helper()
+	config = &Config{
+		UpdateInterval:            time.Minute,
+		MessagePageSize:           maxMessagesPerRequest,
+		MaxConcurrentChannels:     defaultMaxConcurrentChannels,
+		OnChannelError:            onChannelErrorKeep,
+		EmitPerChannelMessages:    true,
+		EmitPerChannelAttachments: true,
+		MessageCountBuckets:       defaultMessageCountBuckets,
+		MessageAgeBuckets:         defaultMessageAgeBuckets,
+		MessagesPerDayLocation:    time.UTC,
+		IncludedChannels:          map[string]struct{}{},
+		ExcludedChannels:          map[string]struct{}{},
+		ExcludedChannelIDs:        map[string]struct{}{},
+		MetricGroups:              map[string]bool{metricGroupMembers: true, metricGroupMessages: true},
+		ServerIDs:                 []string{"g1"},
+	}
+	serverIDs = config.ServerIDs
+	channelWorkers.resize(config.MaxConcurrentChannels)
+	collectorPaused.Store(false)
+	history = nil
+	peerTotals = nil
+	peerSeeds = nil
+	countRoleHolders = nil
+	lastChannelTotals = make(map[string]int)
+	channelTrends = make(map[string]channelTrend)
+	lastMemberCounts = make(map[string]memberCountSample)
+	roleLabels = make(map[string]map[string]bool)
+	knownChannels = make(map[string]*discordgo.Channel)
+	channelBreakers = make(map[string]*channelBreaker)
+	channelCategories = make(map[string]string)
+	noAccessLogged = make(map[string]bool)
+	botJoinedAt = make(map[string]time.Time)
+	lastGuildCounts = make(map[string]time.Time)
+	guildTextChannels = make(map[string][]*discordgo.Channel)
+	channelCursors = make(map[string]channelStats)
+	for _, gauge := range append(channelGauges,
+		memberCountGauge, memberDeltaGauge, membersByTypeGauge, membersByRoleGauge, membersWithFlagGauge,
+		messageCountGauge, recentMessageCountGauge, messageCountTotalGauge, messagesPerMemberGauge,
+		threadMessageCountGauge, channelsNoAccessGauge, channelsExcludedGauge, scrapeUpGauge,
+		attachmentCountTotalGauge, embedCountTotalGauge, voiceChannelMembersGauge, membersOnlineGauge,
+		membersByActivityGauge, guildBansGauge, inviteUsesGauge, channelsCountGauge, rolesCountGauge, categoryCountGauge,
+	) {
+		gauge.Reset()
+	}
+	scrapeErrorsCounter.Reset()
+	apiRequestsCounter.Reset()
+	return config
+}
+
+// seriesValue returns the value of the series of c labelled exactly with
+// labels, and whether there is one.
+func seriesValue(t *testing.T, c prometheus.Collector, labels prometheus.Labels) (float64, bool) {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	value, found := 0.0, false
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if !hasLabels(&m, labels) {
+			continue
+		}
+		found = true
+		switch {
+		case m.Gauge != nil:
+			value = m.Gauge.GetValue()
+		case m.Counter != nil:
+			value = m.Counter.GetValue()
+		}
+	}
+	return value, found
+}
+
+func hasLabels(m *dto.Metric, labels prometheus.Labels) bool {
+	if len(m.GetLabel()) != len(labels) {
+		return false
+	}
+	for _, label := range m.GetLabel() {
+		if value, ok := labels[label.GetName()]; !ok || value != label.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+// wantSeries fails the test unless c has a series with labels and value.
+func wantSeries(t *testing.T, c prometheus.Collector, labels prometheus.Labels, want float64) {
+	t.Helper()
+	got, ok := seriesValue(t, c, labels)
+	if !ok {
+		t.Errorf("no series %v", labels)
+		return
+	}
+	if got != want {
+		t.Errorf("series %v = %v, want %v", labels, got, want)
+	}
+}
+
+// wantNoSeries fails the test if c has a series with labels.
+func wantNoSeries(t *testing.T, c prometheus.Collector, labels prometheus.Labels) {
+	t.Helper()
+	if got, ok := seriesValue(t, c, labels); ok {
+		t.Errorf("series %v = %v, want none", labels, got)
+	}
+}
+
+// messageCountLabels are the labels of discord_message_count of an
+// uncategorized channel of guild g1.
+func messageCountLabels(channel *discordgo.Channel) prometheus.Labels {
+	return prometheus.Labels{"guild": channel.GuildID, "channel": channel.Name, "channel_id": channel.ID, "category": ""}
+}
+
+func TestCountChannelMessagesPaginates(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.messages["c1"] = fakeMessages(250)
+
+	stats, err := countChannelMessages(context.Background(), fake, "c1", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.messages != 250 {
+		t.Errorf("messages = %d, want 250", stats.messages)
+	}
+	if stats.newestID != fake.messages["c1"][0].ID {
+		t.Errorf("newestID = %s, want the newest message %s", stats.newestID, fake.messages["c1"][0].ID)
+	}
+	// 100 件、100 件、50 件の 3 ページ
+	if got := fake.callCount("ChannelMessages"); got != 3 {
+		t.Errorf("ChannelMessages called %d times, want 3", got)
+	}
+}
+
+func TestCountChannelMessagesStopsOnEmptyPage(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.messages["c1"] = fakeMessages(200)
+
+	stats, err := countChannelMessages(context.Background(), fake, "c1", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.messages != 200 {
+		t.Errorf("messages = %d, want 200", stats.messages)
+	}
+	// 2 ページ目がちょうど満杯なので、空の 3 ページ目で終わる
+	if got := fake.callCount("ChannelMessages"); got != 3 {
+		t.Errorf("ChannelMessages called %d times, want 3", got)
+	}
+}
+
+func TestCountChannelMessagesReturnsError(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.messages["c1"] = fakeMessages(150)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && fake.callCount(method) == 2 {
+			return restError(http.StatusBadRequest)
+		}
+		return nil
+	}
+
+	_, err := countChannelMessages(context.Background(), fake, "c1", time.Time{}, "")
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		t.Fatalf("err = %v, want the REST error of the second page", err)
+	}
+}
+
+func TestUpdateMessageCountExcludesChannels(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ExcludedChannels = map[string]struct{}{"random": {}}
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "c1", "general", 3)
+	random := fake.addChannel("g1", "c2", "random", 5)
+
+	results, ok := updateMessageCount(context.Background(), fake, []string{"g1"})
+	if !ok {
+		t.Fatal("updateMessageCount reported a failure")
+	}
+	if len(results) != 1 || results[0].channel.ID != general.ID {
+		t.Fatalf("counted %d channels, want only general", len(results))
+	}
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 3)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(random))
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 3)
+	// 除外したチャンネルのメッセージは取得しない
+	if got := fake.callCount("ChannelMessages"); got != 1 {
+		t.Errorf("ChannelMessages called %d times, want 1", got)
+	}
+}
+
+func TestUpdateMessageCountKeepsFailedChannel(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "c1", "general", 3)
+	random := fake.addChannel("g1", "c2", "random", 5)
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+
+	fake.messages["c1"] = fakeMessages(4)
+	fake.messages["c2"] = fakeMessages(6)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && id == "c2" {
+			return restError(http.StatusBadRequest)
+		}
+		return nil
+	}
+	_, ok := updateMessageCount(context.Background(), fake, []string{"g1"})
+	if ok {
+		t.Error("updateMessageCount reported success with a failed channel")
+	}
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 4)
+	// 失敗したチャンネルは前回の値のまま
+	wantSeries(t, messageCountGauge, messageCountLabels(random), 5)
+	if got := testutil.ToFloat64(scrapeErrorsCounter.WithLabelValues(metricGroupMessages)); got != 1 {
+		t.Errorf("discord_scrape_errors_total{phase=messages} = %v, want 1", got)
+	}
+}
+
+func TestUpdateMessageCountChannelListFails(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildChannels" {
+			return restError(http.StatusBadRequest)
+		}
+		return nil
+	}
+
+	results, ok := updateMessageCount(context.Background(), fake, []string{"g1"})
+	if ok || results != nil {
+		t.Errorf("updateMessageCount = %v, %v, want no results and a failure", results, ok)
+	}
+	wantSeries(t, scrapeUpGauge, prometheus.Labels{"phase": metricGroupMessages}, 0)
+}
+
+func TestUpdateMessageCountAppliesGuildFilters(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ServerIDs = []string{"g1", "g2"}
+	cfg.ExcludedChannels = map[string]struct{}{"random": {}}
+	cfg.Guilds = map[string]*GuildConfig{
+		"g2": {ServerID: "g2", ExcludedChannels: map[string]struct{}{"general": {}}},
+	}
+	fake := newFakeDiscord()
+	general1 := fake.addChannel("g1", "c1", "general", 1)
+	random1 := fake.addChannel("g1", "c2", "random", 2)
+	general2 := fake.addChannel("g2", "c3", "general", 3)
+	random2 := fake.addChannel("g2", "c4", "random", 4)
+
+	if _, ok := updateMessageCount(context.Background(), fake, cfg.ServerIDs); !ok {
+		t.Fatal("updateMessageCount reported a failure")
+	}
+	wantSeries(t, messageCountGauge, messageCountLabels(general1), 1)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(random1))
+	// g2 のブロックの excludeChannels が全体の設定に代わる
+	wantNoSeries(t, messageCountGauge, messageCountLabels(general2))
+	wantSeries(t, messageCountGauge, messageCountLabels(random2), 4)
+	wantSeries(t, channelsExcludedGauge, prometheus.Labels{"guild": "g1"}, 1)
+	wantSeries(t, channelsExcludedGauge, prometheus.Labels{"guild": "g2"}, 1)
+	if got := testutil.ToFloat64(channelsExcludedUnmatchedGauge); got != 0 {
+		t.Errorf("discord_channels_excluded_unmatched = %v, want 0", got)
+	}
+}
+
+func TestDueGuilds(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ServerIDs = []string{"g1", "g2"}
+	cfg.Guilds = map[string]*GuildConfig{"g2": {ServerID: "g2", Interval: 10 * time.Minute}}
+	now := time.Now()
+
+	if got := dueGuilds(cfg.ServerIDs, now); !slices.Equal(got, []string{"g1", "g2"}) {
+		t.Errorf("before the first count dueGuilds = %v, want both", got)
+	}
+	lastGuildCounts["g1"] = now.Add(-time.Minute)
+	lastGuildCounts["g2"] = now.Add(-5 * time.Minute)
+	if got := dueGuilds(cfg.ServerIDs, now); !slices.Equal(got, []string{"g1"}) {
+		t.Errorf("within the interval dueGuilds = %v, want [g1]", got)
+	}
+	// 早めに来た tick でも 1 サイクル遅れない
+	lastGuildCounts["g2"] = now.Add(-10*time.Minute + time.Second)
+	if got := dueGuilds(cfg.ServerIDs, now); !slices.Equal(got, []string{"g1", "g2"}) {
+		t.Errorf("at the interval dueGuilds = %v, want both", got)
+	}
+}
+
+func TestRunCollectionCycleKeepsGuildWithinInterval(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ServerIDs = []string{"g1", "g2"}
+	cfg.MetricGroups = map[string]bool{metricGroupMessages: true}
+	cfg.Guilds = map[string]*GuildConfig{"g2": {ServerID: "g2", Interval: time.Hour}}
+	fake := newFakeDiscord()
+	general1 := fake.addChannel("g1", "101", "general", 1)
+	fake.addChannel("g2", "102", "general", 2)
+	// 名前が重なるので、新しい方のチャンネルには ID が付く
+	general2 := &discordgo.Channel{GuildID: "g2", ID: "102", Name: "general (102)"}
+	runCollectionCycle(context.Background(), fake, cfg.ServerIDs)
+	wantSeries(t, messageCountGauge, messageCountLabels(general2), 2)
+
+	fake.messages["101"] = fakeMessages(5)
+	fake.messages["102"] = fakeMessages(6)
+	runCollectionCycle(context.Background(), fake, cfg.ServerIDs)
+	wantSeries(t, messageCountGauge, messageCountLabels(general1), 5)
+	// 1 時間経つまで g2 は数え直さず、ラベルも変わらない
+	wantSeries(t, messageCountGauge, messageCountLabels(general2), 2)
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g2"}, 2)
+	if got := fake.callCount("GuildChannels"); got != 3 {
+		t.Errorf("GuildChannels called %d times, want 3", got)
+	}
+}
+
+func TestUpdateMemberCountPaginates(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	// 1000 件ずつの 2 ページと 500 件の 3 ページ目
+	fake.addMembers("g1", 2*maxMembersPerRequest+500, 0)
+
+	counts := updateMemberCount(context.Background(), fake, []string{"g1"})
+	if counts["g1"] != 2500 {
+		t.Errorf("member count = %d, want 2500", counts["g1"])
+	}
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 2500)
+	if got := fake.callCount("GuildMembers"); got != 3 {
+		t.Errorf("GuildMembers called %d times, want 3", got)
+	}
+}
+
+func TestMessageCountLabelsChannelNameAndID(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 2)
+	fake.addChannel("g1", "102", "random", 1)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "general", "channel_id": "101", "category": ""}, 2)
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "random", "channel_id": "102", "category": ""}, 1)
+}
+
+func TestIsExcludedChannel(t *testing.T) {
+	general := &discordgo.Channel{GuildID: "g1", ID: "101", Name: "general"}
+	random := &discordgo.Channel{GuildID: "g1", ID: "102", Name: "random"}
+	for _, test := range []struct {
+		name         string
+		names, ids   []string
+		wantExcluded []*discordgo.Channel
+	}{
+		{"by ID", nil, []string{"101"}, []*discordgo.Channel{general}},
+		{"by name", []string{"random"}, nil, []*discordgo.Channel{random}},
+		{"combined", []string{"random"}, []string{"101"}, []*discordgo.Channel{general, random}},
+		{"none", nil, nil, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := setupTest(t)
+			cfg.ExcludedChannels = parseExcludedChannels(test.names)
+			cfg.ExcludedChannelIDs = parseExcludedChannels(test.ids)
+			for _, channel := range []*discordgo.Channel{general, random} {
+				want := slices.Contains(test.wantExcluded, channel)
+				if got := isExcludedChannel(channel); got != want {
+					t.Errorf("isExcludedChannel(%s) = %v, want %v", channel.Name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateMemberCountLabelsEachGuild(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ServerIDs = []string{"g1", "g2"}
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 3, 0)
+	fake.addMembers("g2", 5, 0)
+
+	updateMemberCount(context.Background(), fake, cfg.ServerIDs)
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 3)
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g2", "source": "exact"}, 5)
+}
+
+// maxConcurrentMessageRequests counts the channels of g1 with fake, whose
+// ChannelMessages calls each take a while, with workers workers and returns
+// the most calls that were in flight at once.
+func maxConcurrentMessageRequests(t *testing.T, workers int) int {
+	t.Helper()
+	cfg := setupTest(t)
+	cfg.MaxConcurrentChannels = workers
+	channelWorkers.resize(workers)
+	t.Cleanup(func() { channelWorkers.resize(defaultMaxConcurrentChannels) })
+	fake := newFakeDiscord()
+	for i := 1; i <= 4; i++ {
+		fake.addChannel("g1", fmt.Sprint(100+i), fmt.Sprintf("channel%d", i), 1)
+	}
+	var inFlight, peak atomic.Int32
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				if p := peak.Load(); n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+	if _, ok := updateMessageCount(context.Background(), fake, []string{"g1"}); !ok {
+		t.Fatal("updateMessageCount reported a failure")
+	}
+	return int(peak.Load())
+}
+
+func TestUpdateMessageCountSerialWithOneWorker(t *testing.T) {
+	if got := maxConcurrentMessageRequests(t, 1); got != 1 {
+		t.Errorf("%d channels counted at once with maxConcurrentChannels 1, want 1", got)
+	}
+	if got := maxConcurrentMessageRequests(t, 4); got < 2 {
+		t.Errorf("%d channels counted at once with maxConcurrentChannels 4, want several", got)
+	}
+}
+
+func TestUpdateMessageCountForgetsRemovedChannel(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 2)
+	random := fake.addChannel("g1", "102", "random", 3)
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(random), 3)
+
+	// random が削除された
+	fake.channels["g1"] = fake.channels["g1"][:1]
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 2)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(random))
+	wantNoSeries(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "random"})
+	if _, ok := lastChannelTotals[random.ID]; ok {
+		t.Error("the removed channel's total is still kept")
+	}
+}
+
+func TestUpdateMemberCountByType(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 7, 2)
+
+	counts := updateMemberCount(context.Background(), fake, []string{"g1"})
+	if counts["g1"] != 7 {
+		t.Errorf("member count = %d, want 7", counts["g1"])
+	}
+	wantSeries(t, membersByTypeGauge, prometheus.Labels{"guild": "g1", "type": "human"}, 5)
+	wantSeries(t, membersByTypeGauge, prometheus.Labels{"guild": "g1", "type": "bot"}, 2)
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 7)
+}
+
+func TestCountChannelMessagesStopsAtLookback(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MessagePageSize = 3
+	// 10 件のうち新しい 5 件だけが期間内
+	cfg.MessageLookback = time.Since(testEpoch.Add(4*time.Minute + 30*time.Second))
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 10)
+
+	stats, err := countChannelMessages(context.Background(), fake, general.ID, time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.messages != 5 {
+		t.Errorf("messages = %d, want the 5 within the lookback", stats.messages)
+	}
+	// 2 ページ目で期間外に達したら、それ以上は取得しない
+	if got := fake.callCount("ChannelMessages"); got != 2 {
+		t.Errorf("ChannelMessages called %d times, want 2", got)
+	}
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, recentMessageCountGauge, messageCountLabels(general), 5)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(general))
+}
+
+func TestUpdateMessageCountRecoversFromChannelPanic(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 2)
+	fake.addChannel("g1", "102", "broken", 3)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && id == "102" {
+			panic("boom")
+		}
+		return nil
+	}
+
+	results, ok := updateMessageCount(context.Background(), fake, []string{"g1"})
+	if ok {
+		t.Error("updateMessageCount reported success with a panicking channel")
+	}
+	if len(results) != 1 || results[0].channel.ID != general.ID {
+		t.Fatalf("counted %d channels, want only general", len(results))
+	}
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 2)
+	if got := testutil.ToFloat64(scrapeErrorsCounter.WithLabelValues(metricGroupMessages)); got != 1 {
+		t.Errorf("discord_scrape_errors_total{phase=messages} = %v, want 1", got)
+	}
+}
+
+func TestUpdateMessageCountCancelledMidCount(t *testing.T) {
+	setupTest(t)
+	channelWorkers.resize(1)
+	t.Cleanup(func() { channelWorkers.resize(defaultMaxConcurrentChannels) })
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 2)
+	slow := fake.addChannel("g1", "102", "slow", 3)
+	fake.addChannel("g1", "103", "never", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && id == slow.ID {
+			// 2 つ目のチャンネルを数えている途中で打ち切られる
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	_, ok := updateMessageCount(ctx, fake, []string{"g1"})
+	if ok {
+		t.Error("updateMessageCount reported success after being cancelled")
+	}
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 2)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(slow))
+	// 打ち切ったサイクルの合計は更新せず、エラーにも数えない
+	wantNoSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"})
+	if got := testutil.ToFloat64(scrapeErrorsCounter.WithLabelValues(metricGroupMessages)); got != 0 {
+		t.Errorf("discord_scrape_errors_total{phase=messages} = %v, want 0", got)
+	}
+	if got := fake.callCount("ChannelMessages"); got != 2 {
+		t.Errorf("ChannelMessages called %d times, want no call after the cancellation", got)
+	}
+}
+
+// gatherFamily gathers registry and returns the metric family name, or nil.
+func gatherFamily(t *testing.T, registry prometheus.Gatherer, name string) *dto.MetricFamily {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	return nil
+}
+
+func TestRegisterMetricsPrefixesNames(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MetricNamespace = "myorg"
+	memberCountGauge.WithLabelValues("g1", "exact").Set(3)
+	registry := prometheus.NewRegistry()
+	if err := registerMetrics(registry, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if gatherFamily(t, registry, "myorg_discord_members_count") == nil {
+		t.Error("myorg_discord_members_count is missing")
+	}
+	if gatherFamily(t, registry, "discord_members_count") != nil {
+		t.Error("discord_members_count is still exported without the prefix")
+	}
+}
+
+func TestUpdateGuildInfoCountsChannelsByType(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.guilds["g1"] = &discordgo.Guild{ID: "g1"}
+	fake.addChannel("g1", "101", "general", 0)
+	fake.addChannel("g1", "102", "random", 0)
+	fake.channels["g1"] = append(fake.channels["g1"],
+		&discordgo.Channel{ID: "103", GuildID: "g1", Type: discordgo.ChannelTypeGuildVoice},
+		&discordgo.Channel{ID: "104", GuildID: "g1", Type: discordgo.ChannelTypeGuildCategory},
+		&discordgo.Channel{ID: "105", GuildID: "g1", Type: discordgo.ChannelTypeGuildStore},
+	)
+
+	if !updateGuildInfo(context.Background(), fake, "g1") {
+		t.Fatal("updateGuildInfo failed")
+	}
+	want := map[string]float64{"text": 2, "voice": 1, "category": 1, "other": 1, "announcement": 0, "stage": 0, "forum": 0}
+	for channelType, count := range want {
+		wantSeries(t, channelsCountGauge, prometheus.Labels{"guild": "g1", "type": channelType}, count)
+	}
+}
+
+func TestUpdateMessageCountCountsAttachmentsAndEmbeds(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CountAttachments = true
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "random", 1)
+	fake.messages["101"][0].Attachments = []*discordgo.MessageAttachment{{ID: "a1"}, {ID: "a2"}}
+	fake.messages["101"][1].Embeds = []*discordgo.MessageEmbed{{Title: "link"}}
+	fake.messages["102"][0].Attachments = []*discordgo.MessageAttachment{{ID: "a3"}}
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, attachmentCountGauge, prometheus.Labels{"channel": general.Name}, 2)
+	wantSeries(t, embedCountGauge, prometheus.Labels{"channel": general.Name}, 1)
+	wantSeries(t, attachmentCountGauge, prometheus.Labels{"channel": "random"}, 1)
+	wantSeries(t, embedCountGauge, prometheus.Labels{"channel": "random"}, 0)
+	wantSeries(t, attachmentCountTotalGauge, prometheus.Labels{"guild": "g1"}, 3)
+	wantSeries(t, embedCountTotalGauge, prometheus.Labels{"guild": "g1"}, 1)
+}
+
+func TestUpdateMessageCountCountsReactions(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CountReactions = true
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 4)
+	fake.addChannel("g1", "102", "quiet", 2)
+	fake.messages["101"][0].Reactions = []*discordgo.MessageReactions{{Count: 2, Emoji: &discordgo.Emoji{Name: "👍"}}, {Count: 1, Emoji: &discordgo.Emoji{Name: "🎉"}}}
+	fake.messages["101"][2].Reactions = []*discordgo.MessageReactions{{Count: 3, Emoji: &discordgo.Emoji{Name: "👍"}}}
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// リアクションのないメッセージも平均の分母に入る
+	wantSeries(t, reactionCountGauge, prometheus.Labels{"channel": "general"}, 6)
+	wantSeries(t, reactionsPerMessageGauge, prometheus.Labels{"channel": "general"}, 1.5)
+	wantSeries(t, reactionCountGauge, prometheus.Labels{"channel": "quiet"}, 0)
+	wantSeries(t, reactionsPerMessageGauge, prometheus.Labels{"channel": "quiet"}, 0)
+}
+
+func TestUpdateMessageCountSetsLastMessageTimestamp(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "empty", 0)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	newest := testEpoch.Add(2 * time.Minute)
+	wantSeries(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "general"}, float64(newest.Unix()))
+	// メッセージのないチャンネルには系列を出さない
+	wantNoSeries(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "empty"})
+}
+
+// histogramBuckets returns the sample count and the cumulative count per upper
+// bound of the histogram h collects.
+func histogramBuckets(t *testing.T, h prometheus.Collector) (uint64, map[float64]uint64) {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	h.Collect(ch)
+	close(ch)
+	metric, ok := <-ch
+	if !ok {
+		t.Fatal("no histogram collected")
+	}
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	buckets := make(map[float64]uint64)
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	return m.GetHistogram().GetSampleCount(), buckets
+}
+
+func TestUpdateMessageCountMessageAgeHistogram(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MessageAgeHistogram = true
+	cfg.MessageAgeBuckets = []float64{3600, 86400}
+	fake := newFakeDiscord()
+	now := time.Now()
+	var messages []*discordgo.Message
+	for _, age := range []time.Duration{30 * time.Minute, 2 * time.Hour, 48 * time.Hour} {
+		at := now.Add(-age)
+		messages = append(messages, &discordgo.Message{ID: fakeSnowflake(at), Timestamp: at})
+	}
+	fake.channels["g1"] = []*discordgo.Channel{fakeTextChannel("g1", "101", "general", messages)}
+	fake.messages["101"] = messages
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	count, buckets := histogramBuckets(t, messageAgeHistogram)
+	if count != 3 {
+		t.Errorf("sample count = %d, want 3", count)
+	}
+	// バケットは累積で、2 日前のメッセージはどちらにも入らない
+	if buckets[3600] != 1 || buckets[86400] != 2 {
+		t.Errorf("buckets = %v, want 1 within an hour and 2 within a day", buckets)
+	}
+}
+
+func TestUpdateMessageCountIncludeChannels(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{"include only", []string{"general"}, nil, []string{"general"}},
+		{"include and exclude", []string{"general", "102"}, []string{"random"}, []string{"general"}},
+		{"by ID", []string{"102"}, nil, []string{"random"}},
+		{"missing channel", []string{"nope"}, nil, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := setupTest(t)
+			cfg.IncludedChannels = parseExcludedChannels(test.include)
+			cfg.ExcludedChannels = parseExcludedChannels(test.exclude)
+			fake := newFakeDiscord()
+			fake.addChannel("g1", "101", "general", 3)
+			fake.addChannel("g1", "102", "random", 5)
+			fake.addChannel("g1", "103", "news", 1)
+
+			results, _ := updateMessageCount(context.Background(), fake, []string{"g1"})
+			var counted []string
+			for _, result := range results {
+				counted = append(counted, result.channel.Name)
+			}
+			slices.Sort(counted)
+			if !slices.Equal(counted, test.want) {
+				t.Errorf("counted %v, want %v", counted, test.want)
+			}
+		})
+	}
+}
+
+func TestWarnUnmatchedIncludes(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.IncludedChannels = parseExcludedChannels([]string{"general", "nope"})
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil))) })
+
+	channels := []*discordgo.Channel{{GuildID: "g1", ID: "101", Name: "general"}}
+	warnUnmatchedIncludes(channels, map[string]bool{"g1": true})
+	// 存在しないチャンネルだけを警告する
+	if got := strings.Count(logs.String(), "Included channel not found"); got != 1 || !strings.Contains(logs.String(), "channel=nope") {
+		t.Errorf("logs = %q, want one warning about nope", logs.String())
+	}
+}
+
+func TestRunRecoveredCycleCountsRestart(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" {
+			panic("boom")
+		}
+		return nil
+	}
+	before := testutil.ToFloat64(collectorRestartsCounter)
+
+	if runRecoveredCycle(context.Background(), fake, []string{"g1"}) {
+		t.Error("runRecoveredCycle reported success after a panic")
+	}
+	if got := testutil.ToFloat64(collectorRestartsCounter) - before; got != 1 {
+		t.Errorf("discord_collector_restarts_total increased by %v, want 1", got)
+	}
+	// 次のサイクルは普通に動く
+	fake.fail = nil
+	runRecoveredCycle(context.Background(), fake, []string{"g1"})
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 2)
+}
+
+func TestUpdateMessageCountSameNamedChannels(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "general", 5)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// 古い方が名前を保ち、新しい方には ID が付く
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "general", "channel_id": "101", "category": ""}, 3)
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "general (102)", "channel_id": "102", "category": ""}, 5)
+	wantSeries(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "general"}, float64(testEpoch.Add(2*time.Minute).Unix()))
+	wantSeries(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "general (102)"}, float64(testEpoch.Add(4*time.Minute).Unix()))
+}
+
+func TestNewDiscordTransportUsesHTTPProxy(t *testing.T) {
+	cfg, err := loadTestConfig(t, map[string]any{"httpProxy": "http://proxy:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newDiscordTransport(cfg)
+	proxy, err := transport.Proxy(httptest.NewRequest(http.MethodGet, "https://discord.com/api/v9/users/@me", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy == nil || proxy.String() != "http://proxy:3128" {
+		t.Errorf("proxy = %v, want http://proxy:3128", proxy)
+	}
+
+	_, err = loadTestConfig(t, map[string]any{"httpProxy": "ftp://proxy:21"})
+	if err == nil || !strings.Contains(err.Error(), "scheme must be http, https or socks5") {
+		t.Errorf("err = %v, want the ftp scheme rejected", err)
+	}
+}
+
+func TestUpdateMessageCountByAuthorType(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CountAuthorTypes = true
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 4)
+	fake.messages["101"][0].Author = &discordgo.User{ID: "2000", Username: "helper", Bot: true}
+	fake.messages["101"][1].WebhookID = "3000"
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// Webhook の投稿も bot に数える
+	wantSeries(t, messagesByAuthorTypeGauge, prometheus.Labels{"channel": "general", "author_type": "human"}, 2)
+	wantSeries(t, messagesByAuthorTypeGauge, prometheus.Labels{"channel": "general", "author_type": "bot"}, 2)
+}
+
+func TestUpdateMessageCountCountsPinnedMessages(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CountPinned = true
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 5)
+	fake.addChannel("g1", "102", "random", 2)
+	fake.pinned["101"] = fake.messages["101"][1:3]
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, pinnedMessageCountGauge, prometheus.Labels{"channel": "general"}, 2)
+	wantSeries(t, pinnedMessageCountGauge, prometheus.Labels{"channel": "random"}, 0)
+	if got := testutil.ToFloat64(apiRequestsCounter.WithLabelValues("ChannelMessagesPinned")); got != 2 {
+		t.Errorf("ChannelMessagesPinned requests = %v, want one per channel", got)
+	}
+}
+
+func TestUpdateMessageCountForbiddenChannel(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "staff", 5)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && id == "102" {
+			return restError(http.StatusForbidden)
+		}
+		return nil
+	}
+
+	_, ok := updateMessageCount(context.Background(), fake, []string{"g1"})
+	// 読めないチャンネルは失敗ではなく no access として数える
+	if !ok {
+		t.Error("updateMessageCount reported a failure for a channel the bot can't read")
+	}
+	wantSeries(t, channelsNoAccessGauge, prometheus.Labels{"guild": "g1"}, 1)
+	if got := testutil.ToFloat64(scrapeErrorsCounter.WithLabelValues(metricGroupMessages)); got != 0 {
+		t.Errorf("discord_scrape_errors_total{phase=messages} = %v, want 0", got)
+	}
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 3)
+}
+
+func TestRegisterMetricsIntoTwoRegistries(t *testing.T) {
+	cfg := setupTest(t)
+	memberCountGauge.WithLabelValues("g1", "exact").Set(3)
+	first, second := prometheus.NewRegistry(), prometheus.NewRegistry()
+	for _, registry := range []*prometheus.Registry{first, second} {
+		if err := registerMetrics(registry, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, registry := range []*prometheus.Registry{first, second} {
+		if gatherFamily(t, registry, "discord_members_count") == nil {
+			t.Error("discord_members_count is missing from a registry")
+		}
+	}
+}
+
+func TestUpdateMessageCountTotalExcludesFailedChannels(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "random", 5)
+	news := fake.addChannel("g1", "103", "news", 2)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && id == "102" {
+			return restError(http.StatusBadRequest)
+		}
+		return nil
+	}
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// 合計は数えられたチャンネルの件数の和
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 3)
+	wantSeries(t, messageCountGauge, messageCountLabels(news), 2)
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 5)
+}
+
+func TestUpdateMessageCountCategoryLabel(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.channels["g1"] = []*discordgo.Channel{
+		{ID: "901", GuildID: "g1", Name: "Text", Type: discordgo.ChannelTypeGuildCategory},
+		{ID: "902", GuildID: "g1", Name: "Games", Type: discordgo.ChannelTypeGuildCategory},
+	}
+	general := fake.addChannel("g1", "101", "general", 3)
+	general.ParentID = "901"
+	minecraft := fake.addChannel("g1", "102", "minecraft", 2)
+	minecraft.ParentID = "902"
+	rules := fake.addChannel("g1", "103", "rules", 1)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "general", "channel_id": "101", "category": "Text"}, 3)
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "minecraft", "channel_id": "102", "category": "Games"}, 2)
+	wantSeries(t, messageCountGauge, messageCountLabels(rules), 1)
+	wantSeries(t, categoryCountGauge, prometheus.Labels{"guild": "g1"}, 2)
+
+	// 移動したチャンネルは次のサイクルで新しいカテゴリになる
+	minecraft.ParentID = "901"
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "minecraft", "channel_id": "102", "category": "Text"}, 2)
+	wantNoSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "minecraft", "channel_id": "102", "category": "Games"})
+}
+
+func TestUpdateMessageCountCategoryCountPerGuild(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.channels["g1"] = []*discordgo.Channel{
+		{ID: "901", GuildID: "g1", Name: "Text", Type: discordgo.ChannelTypeGuildCategory},
+	}
+	fake.channels["g2"] = []*discordgo.Channel{
+		{ID: "902", GuildID: "g2", Name: "Text", Type: discordgo.ChannelTypeGuildCategory},
+		{ID: "903", GuildID: "g2", Name: "Games", Type: discordgo.ChannelTypeGuildCategory},
+	}
+	fake.addChannel("g1", "101", "general", 1)
+	fake.addChannel("g2", "102", "general", 1)
+
+	updateMessageCount(context.Background(), fake, []string{"g1", "g2"})
+	wantSeries(t, categoryCountGauge, prometheus.Labels{"guild": "g1"}, 1)
+	wantSeries(t, categoryCountGauge, prometheus.Labels{"guild": "g2"}, 2)
+
+	// 今回数えないギルドは前回の値のまま
+	fake.channels["g1"] = append(fake.channels["g1"], &discordgo.Channel{ID: "904", GuildID: "g1", Name: "Games", Type: discordgo.ChannelTypeGuildCategory})
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, categoryCountGauge, prometheus.Labels{"guild": "g1"}, 2)
+	wantSeries(t, categoryCountGauge, prometheus.Labels{"guild": "g2"}, 2)
+}
+
+func TestRandomJitterWithinBound(t *testing.T) {
+	const bound = 10 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if got := randomJitter(bound); got < 0 || got >= bound {
+			t.Fatalf("randomJitter(%v) = %v, want [0, %v)", bound, got, bound)
+		}
+	}
+}
+
+func TestStartMetricsCollectorWaitsForJitter(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ScrapeJitter = time.Hour
+	fake := newFakeDiscord()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		startMetricsCollector(ctx, fake, []string{"g1"})
+		close(done)
+	}()
+
+	// 最初のサイクルは遅延の間は始まらず、停止すればそのまま終わる
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("startMetricsCollector didn't return when cancelled during the jitter delay")
+	}
+	if got := fake.totalCalls(); got != 0 {
+		t.Errorf("%d Discord calls before the jitter delay passed, want 0", got)
+	}
+}
+
+func TestStartMetricsCollectorFirstCycleWithinJitter(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ScrapeJitter = 50 * time.Millisecond
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 1, 0)
+	fake.addChannel("g1", "101", "general", 1)
+	started := make(chan time.Time, 1)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		select {
+		case started <- time.Now():
+		default:
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		startMetricsCollector(ctx, fake, []string{"g1"})
+		close(done)
+	}()
+	// 次のテストが状態を初期化する前にループを止める
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case at := <-started:
+		if delay := at.Sub(start); delay > cfg.ScrapeJitter+time.Second {
+			t.Errorf("first cycle started after %v, want within the %v jitter", delay, cfg.ScrapeJitter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first cycle didn't start")
+	}
+}
+
+func TestUpdateMessageCountCountsAPIRequests(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 250)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// チャンネル一覧 1 回と、メッセージ 3 ページ
+	for endpoint, want := range map[string]float64{"GuildChannels": 1, "ChannelMessages": 3} {
+		if got := testutil.ToFloat64(apiRequestsCounter.WithLabelValues(endpoint)); got != want {
+			t.Errorf("discord_api_requests_total{endpoint=%s} = %v, want %v", endpoint, got, want)
+		}
+	}
+}
+
+func TestUpdateMessageCountCapsPages(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MaxMessagePagesPerChannel = 2
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 250)
+	fake.addChannel("g1", "102", "random", 50)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// 上限で打ち切った件数は下限値
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 200)
+	wantSeries(t, messageCountCappedGauge, prometheus.Labels{"channel": "general"}, 1)
+	wantSeries(t, messageCountCappedGauge, prometheus.Labels{"channel": "random"}, 0)
+	if got := testutil.ToFloat64(apiRequestsCounter.WithLabelValues("ChannelMessages")); got != 3 {
+		t.Errorf("ChannelMessages requests = %v, want 2 for general and 1 for random", got)
+	}
+}
+
+func TestRunCollectionCycleMembersOnly(t *testing.T) {
+	cfg, err := loadTestConfig(t, map[string]any{"serverID": "g1", "metrics": []any{"members"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t).MetricGroups = cfg.MetricGroups
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addChannel("g1", "101", "general", 3)
+
+	runCollectionCycle(context.Background(), fake, []string{"g1"})
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 2)
+	// messages グループがなければチャンネルもメッセージも取得しない
+	for _, method := range []string{"GuildChannels", "ChannelMessages"} {
+		if got := fake.callCount(method); got != 0 {
+			t.Errorf("%s called %d times with metrics: [members], want 0", method, got)
+		}
+	}
+}
+
+func TestUpdateMessageCountProgressGauges(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MaxConcurrentChannels = 1
+	channelWorkers.resize(1)
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "random", 3)
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var secondID string
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && fake.callCount(method) == 2 {
+			secondID = id
+			close(blocked)
+			<-release
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		updateMessageCount(context.Background(), fake, []string{"g1"})
+		close(done)
+	}()
+	<-blocked
+	// 2 つ目のチャンネルを数えている間は 1 つ目だけが処理済み
+	if got := testutil.ToFloat64(channelsProcessedGauge); got != 1 {
+		t.Errorf("discord_channels_processed = %v while counting %s, want 1", got, secondID)
+	}
+	if got := testutil.ToFloat64(channelsTotalGauge); got != 2 {
+		t.Errorf("discord_channels_total = %v, want 2", got)
+	}
+	close(release)
+	<-done
+	if got := testutil.ToFloat64(channelsProcessedGauge); got != 2 {
+		t.Errorf("discord_channels_processed = %v after the cycle, want 2", got)
+	}
+}
+
+func TestRegisterMetricsAddsConstantLabels(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ConstantLabels = map[string]string{"env": "prod"}
+	memberCountGauge.WithLabelValues("g1", "exact").Set(3)
+	registry := prometheus.NewRegistry()
+	if err := registerMetrics(registry, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	family := gatherFamily(t, registry, "discord_members_count")
+	if family == nil {
+		t.Fatal("discord_members_count is missing")
+	}
+	want := prometheus.Labels{"env": "prod", "guild": "g1", "source": "exact"}
+	if len(family.GetMetric()) != 1 || !hasLabels(family.GetMetric()[0], want) {
+		t.Errorf("discord_members_count = %v, want one series labelled %v", family.GetMetric(), want)
+	}
+}
+
+func TestRunCollectionCycleMessagesPerMember(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ServerIDs = []string{"g1", "g2"}
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 3)
+	fake.members["g1"] = nil
+	fake.addChannel("g2", "201", "general", 8)
+	fake.addMembers("g2", 4, 0)
+	messagesPerMemberGauge.WithLabelValues("g1").Set(5)
+
+	runCollectionCycle(context.Background(), fake, cfg.ServerIDs)
+	wantSeries(t, messagesPerMemberGauge, prometheus.Labels{"guild": "g2"}, 2)
+	// メンバーが 0 人なら 0 で割らずに系列を消す
+	wantNoSeries(t, messagesPerMemberGauge, prometheus.Labels{"guild": "g1"})
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 0)
+}
+
+func TestRunCollectionCycleScrapeUp(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addChannel("g1", "101", "general", 3)
+
+	runCollectionCycle(context.Background(), fake, []string{"g1"})
+	for _, phase := range []string{metricGroupMembers, metricGroupMessages} {
+		wantSeries(t, scrapeUpGauge, prometheus.Labels{"phase": phase}, 1)
+	}
+
+	// 一覧の取得に失敗したら 0 になる
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" || method == "GuildChannels" {
+			return restError(http.StatusBadRequest)
+		}
+		return nil
+	}
+	runCollectionCycle(context.Background(), fake, []string{"g1"})
+	for _, phase := range []string{metricGroupMembers, metricGroupMessages} {
+		wantSeries(t, scrapeUpGauge, prometheus.Labels{"phase": phase}, 0)
+	}
+}
+
+func TestIsExcludedChannelCaseInsensitive(t *testing.T) {
+	for _, caseInsensitive := range []bool{false, true} {
+		cfg, err := loadTestConfig(t, map[string]any{"excludeChannels": "General, LOGS", "excludeCaseInsensitive": caseInsensitive})
+		if err != nil {
+			t.Fatal(err)
+		}
+		setupTest(t)
+		config.ExcludedChannels = cfg.ExcludedChannels
+		config.ExcludeCaseInsensitive = cfg.ExcludeCaseInsensitive
+		for _, name := range []string{"general", "Logs"} {
+			// 既定では大文字小文字を区別する
+			if got := isExcludedChannel(&discordgo.Channel{GuildID: "g1", Name: name}); got != caseInsensitive {
+				t.Errorf("excludeCaseInsensitive=%v: isExcludedChannel(%s) = %v", caseInsensitive, name, got)
+			}
+		}
+	}
+}
+
+func TestUpdateMemberCountFlagsPerGuild(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MemberFlags = []string{"hypesquad_events"}
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addMembers("g2", 2, 0)
+	fake.members["g1"][0].User.PublicFlags = discordgo.UserFlagHypeSquadEvents
+	updateMemberCount(context.Background(), fake, []string{"g1", "g2"})
+	wantSeries(t, membersWithFlagGauge, prometheus.Labels{"guild": "g1", "flag": "hypesquad_events"}, 1)
+	wantSeries(t, membersWithFlagGauge, prometheus.Labels{"guild": "g2", "flag": "hypesquad_events"}, 0)
+
+	// 一覧が取れなかったギルドがあっても、取れたギルドは更新する
+	fake.members["g1"][1].User.PublicFlags = discordgo.UserFlagHypeSquadEvents
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if id == "g2" {
+			return restError(http.StatusInternalServerError)
+		}
+		return nil
+	}
+	updateMemberCount(context.Background(), fake, []string{"g1", "g2"})
+	wantSeries(t, membersWithFlagGauge, prometheus.Labels{"guild": "g1", "flag": "hypesquad_events"}, 2)
+	wantSeries(t, membersWithFlagGauge, prometheus.Labels{"guild": "g2", "flag": "hypesquad_events"}, 0)
+}
+
+func TestUpdateMemberCountFallsBackToApproximate(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CountRoles = true
+	cfg.MemberFlags = []string{"hypesquad_events"}
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 3, 1)
+	fake.members["g1"][1].Roles = []string{"r1"}
+	fake.members["g1"][2].User.PublicFlags = discordgo.UserFlagHypeSquadEvents
+	fake.roles["g1"] = []*discordgo.Role{{ID: "r1", Name: "mod"}}
+	fake.guilds["g1"] = &discordgo.Guild{ID: "g1", ApproximateMemberCount: 50}
+	updateMemberCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, membersByRoleGauge, prometheus.Labels{"guild": "g1", "role": "mod"}, 1)
+	wantSeries(t, membersWithFlagGauge, prometheus.Labels{"guild": "g1", "flag": "hypesquad_events"}, 1)
+
+	// Server Members intent がなくなった
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" {
+			return restError(http.StatusForbidden)
+		}
+		return nil
+	}
+	counts := updateMemberCount(context.Background(), fake, []string{"g1"})
+	if counts["g1"] != 50 {
+		t.Errorf("member count = %d, want the approximate 50", counts["g1"])
+	}
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "approximate"}, 50)
+	// メンバー一覧からしか数えられない系列は古い値のまま残さない
+	wantNoSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"})
+	wantNoSeries(t, membersByTypeGauge, prometheus.Labels{"guild": "g1", "type": "human"})
+	wantNoSeries(t, membersByTypeGauge, prometheus.Labels{"guild": "g1", "type": "bot"})
+	wantNoSeries(t, membersByRoleGauge, prometheus.Labels{"guild": "g1", "role": "mod"})
+	wantNoSeries(t, membersWithFlagGauge, prometheus.Labels{"guild": "g1", "flag": "hypesquad_events"})
+
+	// 一覧が取れるようになれば exact に戻る
+	fake.fail = nil
+	updateMemberCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "exact"}, 3)
+	wantNoSeries(t, memberCountGauge, prometheus.Labels{"guild": "g1", "source": "approximate"})
+	wantSeries(t, membersByRoleGauge, prometheus.Labels{"guild": "g1", "role": "mod"}, 1)
+}
+
+func TestUpdateMessageCountOnChannelError(t *testing.T) {
+	for _, mode := range []string{onChannelErrorKeep, onChannelErrorClear} {
+		t.Run(mode, func(t *testing.T) {
+			loaded, err := loadTestConfig(t, map[string]any{"onChannelError": mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupTest(t).OnChannelError = loaded.OnChannelError
+			fake := newFakeDiscord()
+			random := fake.addChannel("g1", "102", "random", 5)
+			updateMessageCount(context.Background(), fake, []string{"g1"})
+
+			fake.fail = func(ctx context.Context, method, id string) error {
+				if method == "ChannelMessages" {
+					return restError(http.StatusBadRequest)
+				}
+				return nil
+			}
+			updateMessageCount(context.Background(), fake, []string{"g1"})
+			if mode == onChannelErrorKeep {
+				wantSeries(t, messageCountGauge, messageCountLabels(random), 5)
+				if _, ok := seriesValue(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "random"}); !ok {
+					t.Error("keep: discord_channel_last_message_timestamp_seconds was deleted")
+				}
+				return
+			}
+			// clear では失敗したチャンネルの系列を消す
+			wantNoSeries(t, messageCountGauge, messageCountLabels(random))
+			wantNoSeries(t, lastMessageTimestampGauge, prometheus.Labels{"channel": "random"})
+		})
+	}
+
+	if _, err := loadTestConfig(t, map[string]any{"onChannelError": "drop"}); err == nil {
+		t.Error("onChannelError drop was accepted")
+	}
+}
+
+func TestRunTimedCycleCountsOverlaps(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 1, 0)
+	fake.addChannel("g1", "101", "general", 1)
+	before := testutil.ToFloat64(scrapeOverlapsCounter)
+	now := time.Now()
+
+	// 前回のサイクルが終わってからの tick は重なりではない
+	runTimedCycle(context.Background(), fake, []string{"g1"}, now, now.Add(-time.Second))
+	if got := testutil.ToFloat64(scrapeOverlapsCounter) - before; got != 0 {
+		t.Errorf("overlaps increased by %v for a tick after the previous cycle, want 0", got)
+	}
+	// 前回のサイクル中に来ていた tick
+	runTimedCycle(context.Background(), fake, []string{"g1"}, now.Add(-time.Minute), now)
+	if got := testutil.ToFloat64(scrapeOverlapsCounter) - before; got != 1 {
+		t.Errorf("overlaps increased by %v for a tick during the previous cycle, want 1", got)
+	}
+}
+
+func TestCountChannelMessagesUsesPageSize(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MessagePageSize = 10
+	fake := newFakeDiscord()
+	fake.messages["c1"] = fakeMessages(25)
+
+	stats, err := countChannelMessages(context.Background(), fake, "c1", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.messages != 25 {
+		t.Errorf("messages = %d, want 25", stats.messages)
+	}
+	// 10 件、10 件、5 件の 3 ページ
+	if got := fake.callCount("ChannelMessages"); got != 3 {
+		t.Errorf("ChannelMessages called %d times, want 3 pages of 10", got)
+	}
+
+	for value, want := range map[int]int{0: 1, 500: maxMessagesPerRequest, 50: 50} {
+		loaded, err := loadTestConfig(t, map[string]any{"messagePageSize": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.MessagePageSize != want {
+			t.Errorf("messagePageSize %d resolved to %d, want %d", value, loaded.MessagePageSize, want)
+		}
+	}
+}
+
+func TestUpdateMemberCountDelta(t *testing.T) {
+	setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 5, 0)
+
+	// 最初のサイクルには比べる値がない
+	updateMemberCount(context.Background(), fake, []string{"g1"})
+	wantNoSeries(t, memberDeltaGauge, prometheus.Labels{"guild": "g1"})
+
+	fake.members["g1"] = fake.members["g1"][:3]
+	updateMemberCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, memberDeltaGauge, prometheus.Labels{"guild": "g1"}, -2)
+
+	fake.members["g1"] = nil
+	fake.addMembers("g1", 7, 0)
+	updateMemberCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, memberDeltaGauge, prometheus.Labels{"guild": "g1"}, 4)
+}
+
+func TestUpdateChannelTrend(t *testing.T) {
+	setupTest(t)
+	general := &discordgo.Channel{ID: "101", GuildID: "g1", Name: "general"}
+	labels := prometheus.Labels{"channel": "general"}
+	start := time.Now()
+
+	// 1 回目は比べる値がないので出さない
+	updateChannelTrend(general, 10, start)
+	wantNoSeries(t, messagesLastIntervalGauge, labels)
+	wantNoSeries(t, messageRateGauge, labels)
+
+	updateChannelTrend(general, 70, start.Add(time.Minute))
+	wantSeries(t, messagesLastIntervalGauge, labels, 60)
+	wantSeries(t, messageRateGauge, labels, 1)
+	wantNoSeries(t, messageAccelerationGauge, labels)
+
+	// 削除で減った分はマイナスにしない
+	updateChannelTrend(general, 40, start.Add(2*time.Minute))
+	wantSeries(t, messagesLastIntervalGauge, labels, 0)
+	wantSeries(t, messageRateGauge, labels, -0.5)
+	wantSeries(t, messageAccelerationGauge, labels, -1.5)
+}
+
+func TestUpdateMessageCountWithoutPerChannelSeries(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.EmitPerChannelMessages = false
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "random", 5)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// チャンネルごとの系列がなくても合計は出す
+	wantNoSeries(t, messageCountGauge, messageCountLabels(general))
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 8)
+
+	registry := prometheus.NewRegistry()
+	if err := registerMetrics(registry, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if gatherFamily(t, registry, "discord_message_count") != nil {
+		t.Error("discord_message_count is registered with emitPerChannelMessages off")
+	}
+	if gatherFamily(t, registry, "discord_message_count_total") == nil {
+		t.Error("discord_message_count_total is missing with emitPerChannelMessages off")
+	}
+}
+
+func TestUpdateMessageCountUnmatchedExcludes(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.ExcludedChannels = parseExcludedChannels([]string{"random", "typo-channel"})
+	cfg.ExcludedChannelIDs = parseExcludedChannels([]string{"101", "999"})
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "101", "general", 3)
+	fake.addChannel("g1", "102", "random", 5)
+	fake.addChannel("g1", "103", "news", 1)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// どのチャンネルにも当たらない typo-channel と 999 を数える
+	if got := testutil.ToFloat64(channelsExcludedUnmatchedGauge); got != 2 {
+		t.Errorf("discord_channels_excluded_unmatched = %v, want 2", got)
+	}
+	wantSeries(t, channelsExcludedGauge, prometheus.Labels{"guild": "g1"}, 2)
+}
+
+func TestRunCollectionCycleTimesOutWithPartialData(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CycleTimeout = 100 * time.Millisecond
+	cfg.MetricGroups = map[string]bool{metricGroupMessages: true}
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 3)
+	random := fake.addChannel("g1", "102", "random", 5)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "ChannelMessages" && id == random.ID {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	timeouts := testutil.ToFloat64(scrapeTimeoutsCounter)
+
+	start := time.Now()
+	if runCollectionCycle(context.Background(), fake, []string{"g1"}) {
+		t.Error("runCollectionCycle reported success after timing out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cycle took %v, want it aborted after cycleTimeout", elapsed)
+	}
+	if got := testutil.ToFloat64(scrapeTimeoutsCounter) - timeouts; got != 1 {
+		t.Errorf("discord_scrape_timeouts_total increased by %v, want 1", got)
+	}
+	// 打ち切りまでに数えたチャンネルの値は出す
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 3)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(random))
+}
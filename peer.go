@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+const peerFetchTimeout = 10 * time.Second
+
+// peerChannel is a discord_message_count series read from a peer exporter.
+// guild, channelID and category are empty for peers that predate those
+// labels. newestAt is the peer's discord_channel_last_message_timestamp_seconds
+// of the channel, or zero when it has none.
+type peerChannel struct {
+	guild     string
+	name      string
+	channelID string
+	category  string
+	total     int
+	newestAt  time.Time
+}
+
+// fetchPeerTotals scrapes another exporter's metrics endpoint and returns its
+// discord_message_count series, with the time of each channel's newest
+// message. prefix is the peer's metricNamespace prefix, which is assumed to
+// match ours.
+func fetchPeerTotals(peerURL, prefix string) ([]peerChannel, error) {
+	client := &http.Client{Timeout: peerFetchTimeout}
+	resp, err := client.Get(peerURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	family, ok := families[prefix+"discord_message_count"]
+	if !ok {
+		return nil, fmt.Errorf("no %sdiscord_message_count in response", prefix)
+	}
+
+	newestAt := make(map[string]time.Time)
+	for _, metric := range families[prefix+"discord_channel_last_message_timestamp_seconds"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "channel" {
+				newestAt[label.GetValue()] = time.Unix(int64(metric.GetGauge().GetValue()), 0)
+			}
+		}
+	}
+
+	var channels []peerChannel
+	for _, metric := range family.GetMetric() {
+		channel := peerChannel{total: int(metric.GetGauge().GetValue())}
+		for _, label := range metric.GetLabel() {
+			switch label.GetName() {
+			case "channel":
+				channel.name = label.GetValue()
+			case "guild":
+				channel.guild = label.GetValue()
+			case "channel_id":
+				channel.channelID = label.GetValue()
+			case "category":
+				channel.category = label.GetValue()
+			}
+		}
+		if channel.name != "" {
+			channel.newestAt = newestAt[channel.name]
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
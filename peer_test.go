@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// servePeer serves the metrics of a peer exporter with a general channel of 3
+// messages in g1, whose newest message was posted at newestAt, and a channel
+// of 7 messages in g9.
+func servePeer(t *testing.T, newestAt time.Time) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `# TYPE discord_message_count gauge
+discord_message_count{category="",channel="general",channel_id="101",guild="g1"} 3
+discord_message_count{category="",channel="other",channel_id="901",guild="g9"} 7
+# TYPE discord_channel_last_message_timestamp_seconds gauge
+discord_channel_last_message_timestamp_seconds{channel="general"} %d
+`, newestAt.Unix())
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestWarmStartSeedsMonitoredGuilds(t *testing.T) {
+	setupTest(t)
+	warmStart(servePeer(t, testEpoch), []string{"g1"})
+
+	general := prometheus.Labels{"guild": "g1", "channel": "general", "channel_id": "101", "category": ""}
+	wantSeries(t, messageCountGauge, general, 3)
+	wantNoSeries(t, messageCountGauge, prometheus.Labels{"guild": "g9", "channel": "other", "channel_id": "901", "category": ""})
+	if _, ok := knownChannels["101"]; !ok {
+		t.Error("the seeded channel is not registered in knownChannels")
+	}
+	if peerTotals["other"] != 7 {
+		t.Errorf("peerTotals[other] = %d, want 7 for scheduling", peerTotals["other"])
+	}
+}
+
+func TestWarmStartSkipsLookback(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MessageLookback = time.Hour
+	warmStart(servePeer(t, testEpoch), []string{"g1"})
+
+	wantNoSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "general", "channel_id": "101", "category": ""})
+	if len(knownChannels) != 0 {
+		t.Errorf("knownChannels = %v, want none seeded", knownChannels)
+	}
+}
+
+func TestWarmStartForgetsRemovedChannel(t *testing.T) {
+	setupTest(t)
+	warmStart(servePeer(t, testEpoch), []string{"g1"})
+	fake := newFakeDiscord()
+	fake.addChannel("g1", "102", "random", 1)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// 101 はもうないので、ピアから引き継いだ系列も消える
+	wantNoSeries(t, messageCountGauge, prometheus.Labels{"guild": "g1", "channel": "general", "channel_id": "101", "category": ""})
+}
+
+func TestWarmStartContinuesIncrementalCount(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.IncrementalCount = true
+	fake := newFakeDiscord()
+	// ピアは古い 4 件のうち 1 件が消されたあとに 3 件と数えていて、そのあとに 1 件増えた
+	general := fake.addChannel("g1", "101", "general", 5)
+	warmStart(servePeer(t, testEpoch.Add(3*time.Minute)), []string{"g1"})
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 4)
+	if got := fake.callCount("ChannelMessages"); got != 1 {
+		t.Errorf("ChannelMessages called %d times, want 1 for the new messages only", got)
+	}
+	if _, ok := peerSeeds["101"]; ok {
+		t.Error("the peer seed is kept after the channel got its own cursor")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "sync"
+
+// maxWorkerPoolSize bounds the size the worker pool can be resized to.
+const maxWorkerPoolSize = 50
+
+// workerPool limits how many channels are counted at the same time. Unlike a
+// buffered channel semaphore its size can be changed while it is in use:
+// growing it lets waiting workers start right away, shrinking it lets running
+// workers finish and holds new ones back until the pool has drained below the
+// new size.
+type workerPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int
+	active int
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *workerPool) acquire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.active >= p.size {
+		p.cond.Wait()
+	}
+	p.active++
+}
+
+func (p *workerPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	p.cond.Broadcast()
+}
+
+func (p *workerPool) resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = size
+	p.cond.Broadcast()
+}
+
+func (p *workerPool) currentSize() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
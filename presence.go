@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxActivityTopN bounds activityTopN, the number of
+// discord_members_by_activity series.
+const maxActivityTopN = 25
+
+var (
+	membersByActivityGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_members_by_activity",
+			Help: "Number of members currently doing an activity (e.g. playing a game), for the most common activities",
+		},
+		[]string{"activity"},
+	)
+	membersOnlineGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discord_members_online_count",
+			Help: "Number of members that are not offline, from gateway presences",
+		},
+		[]string{"guild"},
+	)
+	// noPresencesLogged keeps the missing presence warning to one per guild.
+	noPresencesLogged sync.Map
+)
+
+// gatewayIntents returns the gateway intents needed by the enabled features,
+// or 0 when no feature needs a gateway connection.
+func gatewayIntents(config *Config) discordgo.Intent {
+	var intents discordgo.Intent
+	if config.ActivityTopN > 0 || config.CountOnline {
+		intents |= discordgo.IntentsGuilds | discordgo.IntentsGuildPresences
+	}
+	if config.CountVoiceMembers {
+		intents |= discordgo.IntentsGuilds | discordgo.IntentsGuildVoiceStates
+	}
+	return intents
+}
+
+// updateActivityCount counts the activities of the presences the gateway has
+// delivered for the guilds, and exports the activityTopN most common ones
+// summed over all guilds.
+func updateActivityCount(state *discordgo.State, serverIDs []string) {
+	counts := make(map[string]int)
+	for _, serverID := range serverIDs {
+		// state.Guild はそれ自体で読み取りロックを取るので、ロックを持ったまま呼ばない
+		guild, err := state.Guild(serverID)
+		if err != nil {
+			slog.Error("Failed to get guild presences", "guild", serverID, "error", err)
+			continue
+		}
+		state.RLock()
+		for _, presence := range guild.Presences {
+			for _, activity := range presence.Activities {
+				// カスタムステータスは名前が常に "Custom Status" なので数えない
+				if activity.Type == discordgo.ActivityTypeCustom || activity.Name == "" {
+					continue
+				}
+				counts[activity.Name]++
+			}
+		}
+		state.RUnlock()
+	}
+
+	activities := make([]string, 0, len(counts))
+	for name := range counts {
+		activities = append(activities, name)
+	}
+	sort.Slice(activities, func(i, j int) bool {
+		if counts[activities[i]] != counts[activities[j]] {
+			return counts[activities[i]] > counts[activities[j]]
+		}
+		return activities[i] < activities[j]
+	})
+	if len(activities) > config.ActivityTopN {
+		activities = activities[:config.ActivityTopN]
+	}
+
+	membersByActivityGauge.Reset()
+	for _, name := range activities {
+		membersByActivityGauge.WithLabelValues(name).Set(float64(counts[name]))
+	}
+}
+
+// updateOnlineCount counts the members of each guild whose presence is not
+// offline. A guild without any presences is skipped, because that means the
+// gateway hasn't delivered presence data rather than that nobody is online.
+func updateOnlineCount(state *discordgo.State, serverIDs []string) {
+	for _, serverID := range serverIDs {
+		// state.Guild はそれ自体で読み取りロックを取るので、ロックを持ったまま呼ばない
+		guild, err := state.Guild(serverID)
+		present, online := 0, 0
+		if err == nil {
+			state.RLock()
+			present = len(guild.Presences)
+			for _, presence := range guild.Presences {
+				if presence.Status != discordgo.StatusOffline && presence.Status != "" {
+					online++
+				}
+			}
+			state.RUnlock()
+		}
+		if present == 0 {
+			if _, logged := noPresencesLogged.LoadOrStore(serverID, true); !logged {
+				slog.Warn("No presence data, skipping discord_members_online_count; is the Presence intent enabled?", "guild", serverID)
+			}
+			continue
+		}
+		membersOnlineGauge.WithLabelValues(serverID).Set(float64(online))
+	}
+}
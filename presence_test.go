@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// presence returns the presence of a member with the status and activities.
+func presence(userID string, status discordgo.Status, activities ...string) *discordgo.Presence {
+	p := &discordgo.Presence{User: &discordgo.User{ID: userID}, Status: status}
+	for _, name := range activities {
+		p.Activities = append(p.Activities, &discordgo.Activity{Name: name, Type: discordgo.ActivityTypeGame})
+	}
+	return p
+}
+
+// stateWithGuild returns a gateway state that has delivered the guild.
+func stateWithGuild(t *testing.T, guild *discordgo.Guild) *discordgo.State {
+	t.Helper()
+	state := discordgo.NewState()
+	if err := state.GuildAdd(guild); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestUpdateOnlineCount(t *testing.T) {
+	setupTest(t)
+	state := stateWithGuild(t, &discordgo.Guild{ID: "g1", Presences: []*discordgo.Presence{
+		presence("1", discordgo.StatusOnline),
+		presence("2", discordgo.StatusIdle),
+		presence("3", discordgo.StatusDoNotDisturb),
+		presence("4", discordgo.StatusOffline),
+	}})
+
+	updateOnlineCount(state, []string{"g1"})
+	wantSeries(t, membersOnlineGauge, prometheus.Labels{"guild": "g1"}, 3)
+}
+
+func TestUpdateOnlineCountSkipsGuildWithoutPresences(t *testing.T) {
+	setupTest(t)
+	state := stateWithGuild(t, &discordgo.Guild{ID: "g1"})
+
+	updateOnlineCount(state, []string{"g1", "g2"})
+	wantNoSeries(t, membersOnlineGauge, prometheus.Labels{"guild": "g1"})
+	wantNoSeries(t, membersOnlineGauge, prometheus.Labels{"guild": "g2"})
+}
+
+// writePresences keeps updating a presence of the guild in the background, as
+// the gateway does, until the returned function is called.
+func writePresences(t *testing.T, state *discordgo.State, guildID string) (stop func()) {
+	t.Helper()
+	done := make(chan struct{})
+	writing := make(chan struct{})
+	go func() {
+		defer close(writing)
+		for i := 0; ; i++ {
+			status := discordgo.StatusOnline
+			if i%2 == 1 {
+				status = discordgo.StatusOffline
+			}
+			if err := state.PresenceAdd(guildID, presence("writer", status, "Chess")); err != nil {
+				t.Error(err)
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-writing
+	}
+}
+
+// runWithin fails the test when update doesn't return within 10s, e.g.
+// because it deadlocked on the state lock.
+func runWithin(t *testing.T, update func()) {
+	t.Helper()
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		update()
+	}()
+	select {
+	case <-returned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("update blocked while the state was being written")
+	}
+}
+
+func TestUpdateOnlineCountWithConcurrentPresenceUpdates(t *testing.T) {
+	setupTest(t)
+	state := stateWithGuild(t, &discordgo.Guild{ID: "g1", Presences: []*discordgo.Presence{
+		presence("1", discordgo.StatusOnline),
+		presence("2", discordgo.StatusOffline),
+	}})
+
+	// ゲートウェイがプレゼンスを書き込んでいる最中に数えても止まらない
+	stop := writePresences(t, state, "g1")
+	runWithin(t, func() {
+		for i := 0; i < 1000; i++ {
+			updateOnlineCount(state, []string{"g1"})
+		}
+	})
+	stop()
+
+	if err := state.PresenceAdd("g1", presence("writer", discordgo.StatusIdle)); err != nil {
+		t.Fatal(err)
+	}
+	updateOnlineCount(state, []string{"g1"})
+	wantSeries(t, membersOnlineGauge, prometheus.Labels{"guild": "g1"}, 2)
+}
+
+func TestUpdateActivityCount(t *testing.T) {
+	config := setupTest(t)
+	config.ActivityTopN = 2
+	state := stateWithGuild(t, &discordgo.Guild{ID: "g1", Presences: []*discordgo.Presence{
+		presence("1", discordgo.StatusOnline, "Chess", "Go"),
+		presence("2", discordgo.StatusOnline, "Chess"),
+		presence("3", discordgo.StatusIdle, "Shogi"),
+		presence("4", discordgo.StatusOnline, "Go"),
+		presence("5", discordgo.StatusOnline, "Chess"),
+	}})
+
+	updateActivityCount(state, []string{"g1"})
+	wantSeries(t, membersByActivityGauge, prometheus.Labels{"activity": "Chess"}, 3)
+	wantSeries(t, membersByActivityGauge, prometheus.Labels{"activity": "Go"}, 2)
+	// 上位 activityTopN 件だけ出す
+	wantNoSeries(t, membersByActivityGauge, prometheus.Labels{"activity": "Shogi"})
+}
+
+func TestUpdateActivityCountWithConcurrentPresenceUpdates(t *testing.T) {
+	config := setupTest(t)
+	config.ActivityTopN = 5
+	state := stateWithGuild(t, &discordgo.Guild{ID: "g1", Presences: []*discordgo.Presence{
+		presence("1", discordgo.StatusOnline, "Chess"),
+	}})
+
+	stop := writePresences(t, state, "g1")
+	runWithin(t, func() {
+		for i := 0; i < 1000; i++ {
+			updateActivityCount(state, []string{"g1"})
+		}
+	})
+	stop()
+
+	updateActivityCount(state, []string{"g1"})
+	wantSeries(t, membersByActivityGauge, prometheus.Labels{"activity": "Chess"}, 2)
+}
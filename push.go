@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// mode values: serve the metrics over HTTP, or push them once to a
+// Pushgateway and exit.
+const (
+	modeServe = "serve"
+	modePush  = "push"
+)
+
+const defaultPushJob = "discord_exporter"
+
+// pushOnce runs a single collection cycle and pushes the metrics gathered
+// from registry to pushgatewayURL, replacing those pushed before under the
+// same job. A partially failed cycle is pushed as well, with the failures
+// showing in discord_scrape_up and discord_scrape_errors_total.
+func pushOnce(ctx context.Context, registry *prometheus.Registry) error {
+	cycleMu.Lock()
+	ok := runRecoveredCycle(ctx, discordSession, serverIDs)
+	cycleMu.Unlock()
+	if !ok {
+		slog.Warn("Collection cycle did not fully succeed, pushing the metrics collected")
+	}
+
+	if err := push.New(config.PushgatewayURL, config.PushJob).Gatherer(registry).PushContext(ctx); err != nil {
+		return fmt.Errorf("failed to push to %s: %w", config.PushgatewayURL, err)
+	}
+	slog.Info("Pushed metrics", "pushgateway", config.PushgatewayURL, "job", config.PushJob)
+	return nil
+}
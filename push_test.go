@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushOnce(t *testing.T) {
+	cfg := setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addChannel("g1", "101", "general", 3)
+	discordSession = fake
+	t.Cleanup(func() { discordSession = nil })
+	registry := prometheus.NewRegistry()
+	if err := registerMetrics(registry, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var method, path string
+	var body []byte
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer pushgateway.Close()
+	cfg.PushgatewayURL = pushgateway.URL
+	cfg.PushJob = defaultPushJob
+
+	if err := pushOnce(context.Background(), registry); err != nil {
+		t.Fatal(err)
+	}
+	// 前回の値を置き換えるので PUT で送る
+	if method != http.MethodPut || path != "/metrics/job/"+defaultPushJob {
+		t.Errorf("pushed with %s %s, want PUT /metrics/job/%s", method, path, defaultPushJob)
+	}
+	for _, name := range []string{"discord_members_count", "discord_message_count"} {
+		if !bytes.Contains(body, []byte(name)) {
+			t.Errorf("pushed body is missing %s", name)
+		}
+	}
+	if fake.callCount("GuildMembers") != 1 {
+		t.Errorf("GuildMembers called %d times, want one cycle before the push", fake.callCount("GuildMembers"))
+	}
+}
+
+func TestPushOnceFails(t *testing.T) {
+	cfg := setupTest(t)
+	discordSession = newFakeDiscord()
+	t.Cleanup(func() { discordSession = nil })
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer pushgateway.Close()
+	cfg.PushgatewayURL = pushgateway.URL
+	cfg.PushJob = defaultPushJob
+
+	err := pushOnce(context.Background(), prometheus.NewRegistry())
+	if err == nil || !strings.Contains(err.Error(), "failed to push to "+pushgateway.URL) {
+		t.Errorf("err = %v, want the failed push reported", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxTopReactionEmoji bounds topReactionEmoji, since every emoji adds one
+// discord_emoji_reaction_count series per channel.
+const maxTopReactionEmoji = 25
+
+var emojiReactionCountGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_emoji_reaction_count",
+		Help: "Number of reactions per channel with its most used emoji",
+	},
+	[]string{"channel", "emoji"},
+)
+
+// reactionEmojiName is the emoji label of a reaction: the character of a
+// unicode emoji or the name of a custom one, falling back to the ID for a
+// deleted custom emoji, which Discord returns without a name.
+func reactionEmojiName(emoji *discordgo.Emoji) string {
+	if emoji.Name != "" {
+		return emoji.Name
+	}
+	return emoji.ID
+}
+
+// updateTopReactionEmoji replaces the channel's discord_emoji_reaction_count
+// series with the topReactionEmoji emoji used most in its reactions.
+func updateTopReactionEmoji(channel *discordgo.Channel, counts map[string]int) {
+	emojiReactionCountGauge.DeletePartialMatch(prometheus.Labels{"channel": channel.Name})
+	for _, emoji := range topKeys(counts, config.TopReactionEmoji) {
+		emojiReactionCountGauge.WithLabelValues(channel.Name, emoji).Set(float64(counts[emoji]))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpdateMessageCountTopReactionEmoji(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		customOnly bool
+		want       map[string]float64
+	}{
+		{"all emoji", false, map[string]float64{"👍": 5, "party": 4}},
+		// 名前のない削除済みのカスタム絵文字は ID で数える
+		{"custom only", true, map[string]float64{"party": 4, "777": 2}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := setupTest(t)
+			cfg.CountReactions = true
+			cfg.TopReactionEmoji = 2
+			cfg.CustomEmojiOnly = test.customOnly
+			emojiReactionCountGauge.Reset()
+			fake := newFakeDiscord()
+			fake.addChannel("g1", "101", "general", 2)
+			fake.messages["101"][0].Reactions = []*discordgo.MessageReactions{
+				{Count: 2, Emoji: &discordgo.Emoji{Name: "👍"}},
+				{Count: 1, Emoji: &discordgo.Emoji{Name: "🎉"}},
+				{Count: 4, Emoji: &discordgo.Emoji{ID: "555", Name: "party"}},
+			}
+			fake.messages["101"][1].Reactions = []*discordgo.MessageReactions{
+				{Count: 3, Emoji: &discordgo.Emoji{Name: "👍"}},
+				{Count: 2, Emoji: &discordgo.Emoji{ID: "777"}},
+			}
+
+			updateMessageCount(context.Background(), fake, []string{"g1"})
+			for emoji, count := range test.want {
+				wantSeries(t, emojiReactionCountGauge, prometheus.Labels{"channel": "general", "emoji": emoji}, count)
+			}
+			if got := testutil.CollectAndCount(emojiReactionCountGauge); got != len(test.want) {
+				t.Errorf("%d emoji series, want %d", got, len(test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// configMu guards the config fields that are replaced when the config file
+// changes: the channel inclusions and exclusions, the guilds blocks and the
+// update interval.
+var configMu sync.RWMutex
+
+var (
+	configReloadsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_config_reloads_total",
+		Help: "Number of config file changes that were applied",
+	})
+	configReloadErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_config_reload_errors_total",
+		Help: "Number of config file changes that were ignored because they failed validation",
+	})
+	// configLastReloadGauge is first set when the config is loaded at startup.
+	configLastReloadGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discord_config_last_reload_timestamp_seconds",
+		Help: "Unix time the config was last loaded, at startup or from a changed file",
+	})
+)
+
+// currentUpdateInterval returns config.UpdateInterval, which may be reloaded.
+func currentUpdateInterval() time.Duration {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config.UpdateInterval
+}
+
+// currentCycleTimeout returns how long a collection cycle may run:
+// cycleTimeout, or the current update interval when that is unset.
+func currentCycleTimeout() time.Duration {
+	if config.CycleTimeout > 0 {
+		return config.CycleTimeout
+	}
+	return currentUpdateInterval()
+}
+
+// reloadMu serializes the reloads of the config file and the override file,
+// which are watched separately.
+var reloadMu sync.Mutex
+
+// watchConfig reloads the config whenever the config file or the override
+// file changes. Only the channel inclusions, exclusions, guilds blocks and
+// updateInterval are applied at runtime; changes to other settings are logged
+// and take effect after a restart. A file that doesn't validate is ignored and
+// the running config is kept. initial is the config as loaded at startup,
+// before the server ID was detected. Without either file there is nothing to
+// watch.
+func watchConfig(initial Config) {
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(event fsnotify.Event) {
+			reloadMu.Lock()
+			defer reloadMu.Unlock()
+			reloadConfig(initial, event.Name)
+		})
+		viper.WatchConfig()
+	}
+	if path := viper.GetString("overrideConfig"); path != "" {
+		watchOverrideConfig(initial, path)
+	}
+}
+
+// watchOverrideConfig reloads the config whenever the override file at path
+// is written or replaced. Like viper does for the config file, it watches the
+// file's directory, since editors often save by replacing the file.
+func watchOverrideConfig(initial Config, path string) {
+	file := filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to watch the override config file, changes to it take effect after a restart", "file", file, "error", err)
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != file || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+				reloadMu.Lock()
+				reloadOverrideConfig(initial, file)
+				reloadMu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Error watching the override config file", "file", file, "error", err)
+			}
+		}
+	}()
+}
+
+// reloadOverrideConfig reloads the config after the override file changed.
+// The settings merged from its previous version are dropped first by reading
+// the config file again, or by clearing them when there is none, so that a
+// setting removed from the override file falls back to the lower sources.
+func reloadOverrideConfig(initial Config, file string) {
+	var err error
+	if viper.ConfigFileUsed() != "" {
+		err = viper.ReadInConfig()
+	} else {
+		viper.SetConfigType("yaml")
+		err = viper.ReadConfig(strings.NewReader(""))
+	}
+	if err != nil {
+		configReloadErrorsCounter.Inc()
+		slog.Error("Ignoring invalid config change", "file", file, "error", err)
+		return
+	}
+	reloadConfig(initial, file)
+}
+
+// reloadConfig validates the config viper has read from the changed file,
+// with overrideConfig merged over it again, and applies it, counting the
+// outcome in discord_config_reloads_total or discord_config_reload_errors_total.
+func reloadConfig(initial Config, file string) {
+	err := mergeOverrideConfig()
+	var next *Config
+	if err == nil {
+		next, err = configFromViper()
+	}
+	if err != nil {
+		configReloadErrorsCounter.Inc()
+		slog.Error("Ignoring invalid config change", "file", file, "error", err)
+		return
+	}
+	applyConfigChange(initial, next)
+	configReloadsCounter.Inc()
+	configLastReloadGauge.SetToCurrentTime()
+}
+
+// applyConfigChange swaps the reloadable fields of next into config.
+func applyConfigChange(initial Config, next *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	// 起動時に決まる設定は再起動するまで反映しない
+	if next.Token != initial.Token || !slices.Equal(next.ServerIDs, initial.ServerIDs) || next.MetricsPort != initial.MetricsPort {
+		slog.Warn("Changes to token, serverID, serverIDs or metricsPort take effect after a restart")
+	}
+
+	config.IncludedChannels = next.IncludedChannels
+	config.ExcludedChannels = next.ExcludedChannels
+	config.ExcludeCaseInsensitive = next.ExcludeCaseInsensitive
+	config.ExcludedChannelIDs = next.ExcludedChannelIDs
+	config.ExcludedChannelPatterns = next.ExcludedChannelPatterns
+	config.Guilds = next.Guilds
+	config.UpdateInterval = next.UpdateInterval
+	slog.Info("Config reloaded",
+		"included_channels", len(config.IncludedChannels),
+		"excluded_channels", len(config.ExcludedChannels),
+		"excluded_channel_ids", len(config.ExcludedChannelIDs),
+		"excluded_channel_patterns", len(config.ExcludedChannelPatterns),
+		"guilds", len(config.Guilds),
+		"update_interval", config.UpdateInterval)
+}
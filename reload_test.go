@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+)
+
+func TestApplyConfigChangeUpdatesExclusions(t *testing.T) {
+	cfg := setupTest(t)
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 3)
+	random := fake.addChannel("g1", "102", "random", 5)
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, messageCountGauge, messageCountLabels(random), 5)
+
+	next, err := loadTestConfig(t, map[string]any{"serverID": "g1", "excludeChannels": "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfigChange(*cfg, next)
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// 再読み込み後のサイクルから除外が効く
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 3)
+	wantNoSeries(t, messageCountGauge, messageCountLabels(random))
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 3)
+}
+
+func TestReloadConfigCountsOutcome(t *testing.T) {
+	cfg := setupTest(t)
+	if _, err := loadTestConfig(t, map[string]any{"serverID": "g1", "excludeChannels": "random"}); err != nil {
+		t.Fatal(err)
+	}
+	reloads, failures := testutil.ToFloat64(configReloadsCounter), testutil.ToFloat64(configReloadErrorsCounter)
+
+	reloadConfig(*cfg, "config.yaml")
+	if _, ok := config.ExcludedChannels["random"]; !ok {
+		t.Error("the valid change wasn't applied")
+	}
+	if got := testutil.ToFloat64(configReloadsCounter) - reloads; got != 1 {
+		t.Errorf("discord_config_reloads_total increased by %v, want 1", got)
+	}
+
+	// 検証に失敗した変更は数えて、動いている設定はそのまま使う
+	interval := config.UpdateInterval
+	viper.Set("excludeChannels", "general")
+	viper.Set("updateInterval", "soon")
+	reloadConfig(*cfg, "config.yaml")
+	if got := testutil.ToFloat64(configReloadErrorsCounter) - failures; got != 1 {
+		t.Errorf("discord_config_reload_errors_total increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(configReloadsCounter) - reloads; got != 1 {
+		t.Errorf("discord_config_reloads_total increased by %v after an invalid change, want still 1", got)
+	}
+	if _, ok := config.ExcludedChannels["general"]; ok || config.UpdateInterval != interval {
+		t.Error("the invalid change was applied")
+	}
+}
+
+func TestReloadOverrideConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	base := writeConfigFile(t, "discord-exporter.yaml", "token: file-token\nserverID: g1\nexcludeChannels: [logs]\n")
+	override := writeConfigFile(t, "prod.yaml", "excludeChannels: [random]\nupdateInterval: 10m\n")
+	loaded, err := loadConfig([]string{"--config", base, "--overrideConfig", override})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t)
+	config.ExcludedChannels = loaded.ExcludedChannels
+	config.UpdateInterval = loaded.UpdateInterval
+
+	// 上書きファイルから消した設定は設定ファイルの値に戻る
+	if err := os.WriteFile(override, []byte("excludeChannels: [staff]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadOverrideConfig(*loaded, override)
+	if got := strings.Join(sortedKeys(config.ExcludedChannels), ","); got != "staff" {
+		t.Errorf("excludeChannels = %s after the override changed, want staff", got)
+	}
+	if config.UpdateInterval != defaultUpdateInterval {
+		t.Errorf("updateInterval = %s after it was removed from the override, want the default %s", config.UpdateInterval, defaultUpdateInterval)
+	}
+}
+
+func TestWatchConfigReloadsOverrideFile(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	override := writeConfigFile(t, "prod.yaml", "excludeChannels: [random]\n")
+	t.Setenv(envPrefix+"_SERVERID", "g1")
+	t.Setenv(tokenEnv, "env-token")
+	loaded, err := loadConfig([]string{"--overrideConfig", override})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t).ExcludedChannels = loaded.ExcludedChannels
+	watchConfig(*loaded)
+
+	if err := os.WriteFile(override, []byte("excludeChannels: [staff]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		configMu.RLock()
+		_, reloaded := config.ExcludedChannels["staff"]
+		configMu.RUnlock()
+		if reloaded {
+			return
+		}
+	}
+	t.Error("the change to the override file wasn't applied")
+}
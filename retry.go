@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMaxRetries = 3
+	maxRetryDelay     = 30 * time.Second
+)
+
+// retryBaseDelay is the delay before the first retry, doubled for every
+// further one. It is a variable so that tests can shorten it.
+var retryBaseDelay = time.Second
+
+var (
+	rateLimitedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discord_rate_limited_total",
+		Help: "Number of Discord API requests rejected with 429 Too Many Requests",
+	})
+	// apiRequestsCounter is incremented for every attempt of a request, so
+	// retries are counted as the separate requests they are.
+	apiRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discord_api_requests_total",
+			Help: "Number of Discord API requests sent, by endpoint",
+		},
+		[]string{"endpoint"},
+	)
+)
+
+// withRetry calls fn until it succeeds, fails with a non-transient error or
+// maxRetries retries are used up. Transient errors (network errors and 5xx
+// responses) are retried with exponential backoff. A rate limited request is
+// repeated after its RetryAfter without using up a retry, since the session
+// is created with ShouldRetryOnRateLimit disabled and leaves 429s to us. Once
+// ctx is done it stops waiting and returns ctx.Err().
+func withRetry[T any](ctx context.Context, what string, fn func() (T, error)) (T, error) {
+	delay := retryBaseDelay
+	for attempt := 0; ; {
+		result, err := fn()
+		if err == nil {
+			return result, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return result, ctxErr
+		}
+
+		var rateLimitErr *discordgo.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			rateLimitedCounter.Inc()
+			rateLimitWait.Add(int64(rateLimitErr.RetryAfter))
+			slog.Info("Rate limited, retrying", "url", rateLimitErr.URL, "retry_after", rateLimitErr.RetryAfter)
+			if err := sleepContext(ctx, rateLimitErr.RetryAfter); err != nil {
+				return result, err
+			}
+			continue
+		}
+		if !isTransient(err) || attempt >= config.MaxRetries {
+			return result, err
+		}
+		attempt++
+		slog.Warn("Request failed, retrying", "request", what, "delay", delay, "attempt", attempt, "max_retries", config.MaxRetries, "error", err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return result, err
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// sleepContext waits for d, or returns ctx.Err() as soon as ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isTransient reports whether a failed request may succeed when repeated.
+// Discord's error responses other than 5xx won't change on a retry.
+func isTransient(err error) bool {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		return restErr.Response != nil && restErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// isForbidden reports whether the request was rejected with 403 Forbidden,
+// e.g. as Missing Access (50001) or Missing Permissions (50013), which won't
+// change until the bot's permissions do.
+func isForbidden(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden
+}
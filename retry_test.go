@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// shortRetryDelay shortens the backoff of withRetry for the test.
+func shortRetryDelay(t *testing.T) {
+	t.Helper()
+	previous := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = previous })
+}
+
+func TestWithRetryRecoversFromTransientErrors(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MaxRetries = 3
+	shortRetryDelay(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 4, 0)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		// 最初の 2 回は 502 で失敗する
+		if fake.callCount(method) <= 2 {
+			return restError(http.StatusBadGateway)
+		}
+		return nil
+	}
+
+	counts := updateMemberCount(context.Background(), fake, []string{"g1"})
+	if counts["g1"] != 4 {
+		t.Errorf("member count = %d, want 4", counts["g1"])
+	}
+	if got := fake.callCount("GuildMembers"); got != 3 {
+		t.Errorf("GuildMembers called %d times, want 3", got)
+	}
+}
+
+func TestWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MaxRetries = 2
+	shortRetryDelay(t)
+	calls := 0
+	_, err := withRetry(context.Background(), "test", func() (int, error) {
+		calls++
+		return 0, restError(http.StatusInternalServerError)
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("withRetry = %v after %d calls, want an error after 3", err, calls)
+	}
+}
+
+func TestWithRetryDoesNotRetryClientErrors(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.MaxRetries = 3
+	calls := 0
+	_, err := withRetry(context.Background(), "test", func() (int, error) {
+		calls++
+		return 0, restError(http.StatusNotFound)
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("withRetry = %v after %d calls, want the 404 after 1", err, calls)
+	}
+}
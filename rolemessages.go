@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var roleMessageCountGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_role_message_count",
+		Help: "Number of messages per channel posted by members holding countRoleID",
+	},
+	[]string{"channel"},
+)
+
+// countRoleHolders are the IDs of the users holding countRoleID, fetched at
+// the start of every message cycle. It is nil when countRoleID is unset or
+// the members of a server couldn't be fetched, and then no message is tallied
+// for discord_role_message_count in that cycle.
+var countRoleHolders map[string]bool
+
+// fetchCountRoleHolders lists the members of every server and returns the IDs
+// of those holding countRoleID. A role ID belongs to a single server, so the
+// other servers contribute nobody. Messages don't carry their author's roles
+// when fetched over REST, hence the member lists.
+func fetchCountRoleHolders(ctx context.Context, discordSession discordClient, serverIDs []string) map[string]bool {
+	holders := make(map[string]bool)
+	for _, serverID := range serverIDs {
+		members, err := fetchAllMembers(ctx, discordSession, serverID)
+		if err != nil {
+			scrapeErrorsCounter.WithLabelValues(metricGroupMessages).Inc()
+			slog.Error("Failed to get guild members for countRoleID, keeping the previous role message counts", "guild", serverID, "error", err)
+			return nil
+		}
+		for _, member := range members {
+			if member.User == nil {
+				continue
+			}
+			for _, roleID := range member.Roles {
+				if roleID == config.CountRoleID {
+					holders[member.User.ID] = true
+					break
+				}
+			}
+		}
+	}
+	slog.Debug("Fetched the holders of countRoleID", "role_id", config.CountRoleID, "members", len(holders))
+	return holders
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateMessageCountCountsRoleMessages(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.CountRoleID = "r1"
+	roleMessageCountGauge.Reset()
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 3, 0)
+	fake.members["g1"][0].Roles = []string{"r1"}
+	fake.members["g1"][1].Roles = []string{"r2"}
+	general := fake.addChannel("g1", "101", "general", 5)
+	for i, author := range []string{"1", "2", "1", "3", "1"} {
+		fake.messages["101"][i].Author = &discordgo.User{ID: author}
+	}
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	// ロールを持つユーザー 1 の投稿だけを数え、全体の件数はそのまま
+	wantSeries(t, roleMessageCountGauge, prometheus.Labels{"channel": "general"}, 3)
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 5)
+
+	// メンバー一覧が取れなければ前回の値を残す
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" {
+			return restError(http.StatusForbidden)
+		}
+		return nil
+	}
+	fake.messages["101"][1].Author = &discordgo.User{ID: "1"}
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, roleMessageCountGauge, prometheus.Labels{"channel": "general"}, 3)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// registerHandlers serves the metrics gathered from registry on /metrics,
+// along with the health and admin endpoints. ctx is cancelled when the
+// exporter shuts down, which aborts the cycles /refresh runs.
+func registerHandlers(ctx context.Context, config *Config, registry *prometheus.Registry) {
+	metricsPath := config.PathPrefix + "/metrics"
+	http.Handle(metricsPath, newMetricsHandler(config, registry))
+	http.HandleFunc(config.PathPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != config.PathPrefix+"/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html><head><title>Discord Exporter</title></head><body><h1>Discord Exporter</h1><p><a href="%s">Metrics</a></p></body></html>`, metricsPath)
+	})
+
+	http.HandleFunc(config.PathPrefix+"/health/fresh", handleFreshness(config))
+	http.HandleFunc(config.PathPrefix+"/healthz", handleHealthz(config))
+
+	// 管理用エンドポイントは adminToken が設定されている場合のみ有効
+	if config.AdminToken != "" {
+		http.Handle(config.PathPrefix+"/pause", requireAdmin(config.AdminToken, postOnly(handlePause)))
+		http.Handle(config.PathPrefix+"/resume", requireAdmin(config.AdminToken, postOnly(handleResume)))
+		http.Handle(config.PathPrefix+"/workers", requireAdmin(config.AdminToken, postOnly(handleResizeWorkers)))
+		http.Handle(config.PathPrefix+"/refresh", requireAdmin(config.AdminToken, postOnly(handleRefresh(ctx, config))))
+	}
+}
+
+// newMetricsHandler returns the handler of /metrics, behind basic auth when
+// metricsUsername is set. The metric families are encoded straight into the
+// response as they are rendered, so the body of a large registry is streamed
+// in chunks instead of being buffered as a whole.
+func newMetricsHandler(config *Config, registry *prometheus.Registry) http.Handler {
+	var metricsHandler http.Handler = promhttp.InstrumentMetricHandler(registry, handleMetrics(registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: config.EnableOpenMetrics,
+	}))
+	if config.MetricsUsername != "" {
+		metricsHandler = requireBasicAuth(config.MetricsUsername, config.MetricsPassword, metricsHandler)
+	}
+	return metricsHandler
+}
+
+// listenMetrics binds the metrics port, so that a port in use is reported
+// before any work is done rather than once the server starts.
+func listenMetrics(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't bind metricsPort: %w", err)
+	}
+	return ln, nil
+}
+
+// handleMetrics serves every metric of gatherer, or with ?channel=NAME only the
+// series whose channel label is NAME. A channel without any series, i.e. one
+// that isn't counted, is answered with 400. The filter doesn't restrict
+// access, every caller may ask for any channel.
+func handleMetrics(gatherer prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	all := promhttp.HandlerFor(gatherer, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !query.Has("channel") {
+			all.ServeHTTP(w, r)
+			return
+		}
+		channel := query.Get("channel")
+		families, err := gatherChannel(gatherer, channel)
+		if err == nil && len(families) == 0 {
+			http.Error(w, fmt.Sprintf("unknown channel %q", channel), http.StatusBadRequest)
+			return
+		}
+		promhttp.HandlerFor(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, err
+		}), opts).ServeHTTP(w, r)
+	})
+}
+
+// gatherChannel gathers the metrics of gatherer and keeps the series labelled
+// with the channel, dropping the families left without any.
+func gatherChannel(gatherer prometheus.Gatherer, channel string) ([]*dto.MetricFamily, error) {
+	families, err := gatherer.Gather()
+	filtered := families[:0]
+	for _, family := range families {
+		kept := family.Metric[:0]
+		for _, metric := range family.Metric {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "channel" && label.GetValue() == channel {
+					kept = append(kept, metric)
+					break
+				}
+			}
+		}
+		if len(kept) > 0 {
+			family.Metric = kept
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered, err
+}
+
+// handleFreshness reports unhealthy once no cycle has completed for
+// staleAfterIntervals update intervals. Until the first cycle completes the
+// process start time is used, so a long first scan isn't reported as stale.
+func handleFreshness(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		threshold := time.Duration(config.StaleAfterIntervals * float64(currentUpdateInterval()))
+		if collectorPaused.Load() {
+			fmt.Fprintln(w, "paused")
+			return
+		}
+		last := startedAt
+		if nanos := lastCycleSuccess.Load(); nanos != 0 {
+			last = time.Unix(0, nanos)
+		}
+		if age := time.Since(last); age > threshold {
+			http.Error(w, fmt.Sprintf("stale: last successful cycle %v ago", age.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// healthzResponse is the JSON body of /healthz. LastScrape is empty until the
+// first fully successful cycle.
+type healthzResponse struct {
+	Status     string `json:"status"`
+	LastScrape string `json:"lastScrape"`
+}
+
+// handleHealthz reports unhealthy once no cycle has succeeded in every enabled
+// phase for staleAfterIntervals update intervals, e.g. because Discord can't be
+// reached. Like /health/fresh it measures from the process start until the
+// first success.
+func handleHealthz(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		threshold := time.Duration(config.StaleAfterIntervals * float64(currentUpdateInterval()))
+		resp := healthzResponse{Status: "ok"}
+		last := startedAt
+		if nanos := lastScrapeSuccess.Load(); nanos != 0 {
+			last = time.Unix(0, nanos)
+			resp.LastScrape = last.UTC().Format(time.RFC3339)
+		}
+		status := http.StatusOK
+		if time.Since(last) > threshold && !collectorPaused.Load() {
+			resp.Status = "unhealthy"
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("Failed to write /healthz response", "error", err)
+		}
+	}
+}
+
+// requireAdmin only lets requests through that carry the admin token as a
+// bearer token.
+func requireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireBasicAuth only lets requests through that carry the given username
+// and password as HTTP basic auth credentials.
+func requireBasicAuth(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		givenUser, givenPassword, ok := r.BasicAuth()
+		// 両方とも比較して、どちらが違うのかを応答時間から推測されないようにする
+		userOK := subtle.ConstantTimeCompare([]byte(givenUser), []byte(username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="discord-exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func postOnly(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	if collectorPaused.CompareAndSwap(false, true) {
+		slog.Info("Collector paused", "remote", r.RemoteAddr)
+	}
+	fmt.Fprintln(w, "paused")
+}
+
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if collectorPaused.CompareAndSwap(true, false) {
+		slog.Info("Collector resumed", "remote", r.RemoteAddr)
+	}
+	fmt.Fprintln(w, "resumed")
+}
+
+func handleResizeWorkers(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size < 1 || size > maxWorkerPoolSize {
+		http.Error(w, fmt.Sprintf("size must be an integer between 1 and %d", maxWorkerPoolSize), http.StatusBadRequest)
+		return
+	}
+	previous := channelWorkers.currentSize()
+	channelWorkers.resize(size)
+	slog.Info("Worker pool resized", "from", previous, "to", size, "remote", r.RemoteAddr)
+	fmt.Fprintf(w, "workers: %d\n", size)
+}
+
+// refreshResponse is the JSON body of a /refresh that ran a cycle.
+type refreshResponse struct {
+	Status   string  `json:"status"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+// handleRefresh runs a collection cycle right away and answers once it is
+// done. If a cycle is already running, whether timed or another refresh, it
+// answers 202 without starting a second one, since the running cycle brings
+// fresh values anyway. The write deadline is extended by cycleTimeout, so that
+// a cycle longer than writeTimeout can still be answered, and the cycle is
+// aborted when ctx is cancelled.
+func handleRefresh(ctx context.Context, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if collectorPaused.Load() {
+			http.Error(w, "collector is paused", http.StatusConflict)
+			return
+		}
+		if !cycleMu.TryLock() {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "a collection cycle is already running")
+			return
+		}
+		defer cycleMu.Unlock()
+
+		deadline := time.Now().Add(currentCycleTimeout() + config.WriteTimeout)
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.Warn("Failed to extend the /refresh write deadline", "error", err)
+		}
+
+		slog.Info("Refresh requested", "remote", r.RemoteAddr)
+		start := time.Now()
+		// クライアントが切断してもサイクルは最後まで実行し、終了するときだけ中断する
+		resp := refreshResponse{Status: "ok"}
+		if !runRecoveredCycle(ctx, discordSession, serverIDs) {
+			resp.Status = "partial"
+		}
+		resp.Duration = time.Since(start).Seconds()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("Failed to write /refresh response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeRecorder records the size of every write to the response.
+type writeRecorder struct {
+	*httptest.ResponseRecorder
+	writes []int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestMetricsHandlerStreamsLargeRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_large", Help: "Many series"}, []string{"channel"})
+	registry.MustRegister(gauge)
+	for i := 0; i < 5000; i++ {
+		gauge.WithLabelValues("channel-" + strconv.Itoa(i)).Set(float64(i))
+	}
+	handler := newMetricsHandler(&Config{MetricsUsername: "prom", MetricsPassword: "secret"}, registry)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("prom", "secret")
+	w := &writeRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `test_large{channel="channel-4999"} 4999`) {
+		t.Fatal("the last series is missing from the body")
+	}
+	if len(w.writes) < 2 {
+		t.Fatalf("body written in %d writes, want it streamed in several", len(w.writes))
+	}
+	for _, n := range w.writes {
+		if n >= len(body) {
+			t.Errorf("a write of %d bytes carried the whole %d byte body", n, len(body))
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.StaleAfterIntervals = 3
+	server := httptest.NewServer(handleHealthz(cfg))
+	defer server.Close()
+	t.Cleanup(func() { lastScrapeSuccess.Store(0) })
+
+	for _, test := range []struct {
+		name       string
+		lastScrape time.Time
+		wantStatus int
+		wantBody   string
+	}{
+		{"healthy", time.Now(), http.StatusOK, `"status":"ok"`},
+		{"unhealthy", time.Now().Add(-time.Hour), http.StatusServiceUnavailable, `"status":"unhealthy"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lastScrapeSuccess.Store(test.lastScrape.UnixNano())
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != test.wantStatus || !strings.Contains(string(body), test.wantBody) {
+				t.Errorf("GET /healthz = %d %s, want %d with %s", resp.StatusCode, body, test.wantStatus, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerRequiresBasicAuth(t *testing.T) {
+	server := httptest.NewServer(newMetricsHandler(&Config{MetricsUsername: "prom", MetricsPassword: "secret"}, prometheus.NewRegistry()))
+	defer server.Close()
+
+	for _, test := range []struct {
+		name               string
+		username, password string
+		want               int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "prom", "guess", http.StatusUnauthorized},
+		{"correct", "prom", "secret", http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.want)
+			}
+			if test.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestHandleRefreshRunsOneCycleAtATime(t *testing.T) {
+	cfg := setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addChannel("g1", "101", "general", 3)
+	started, release := make(chan struct{}), make(chan struct{})
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" && fake.callCount(method) == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+	discordSession = fake
+	t.Cleanup(func() { discordSession = nil })
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handleRefresh(context.Background(), cfg)(first, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+		close(done)
+	}()
+	<-started
+	// 実行中のサイクルがあれば 2 つ目は始めずに 202 を返す
+	second := httptest.NewRecorder()
+	handleRefresh(context.Background(), cfg)(second, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+	close(release)
+	<-done
+
+	if second.Code != http.StatusAccepted {
+		t.Errorf("second refresh status = %d, want 202", second.Code)
+	}
+	if first.Code != http.StatusOK || !strings.Contains(first.Body.String(), `"status":"ok"`) {
+		t.Errorf("first refresh = %d %s, want 200 ok", first.Code, first.Body.String())
+	}
+	if got := fake.callCount("GuildMembers"); got != 1 {
+		t.Errorf("GuildMembers called %d times, want 1", got)
+	}
+}
+
+func TestHandleRefreshOutlastsWriteTimeout(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.WriteTimeout = 50 * time.Millisecond
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addChannel("g1", "101", "general", 3)
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" {
+			time.Sleep(4 * cfg.WriteTimeout)
+		}
+		return nil
+	}
+	discordSession = fake
+	t.Cleanup(func() { discordSession = nil })
+	server := httptest.NewUnstartedServer(handleRefresh(context.Background(), cfg))
+	server.Config.WriteTimeout = cfg.WriteTimeout
+	server.Start()
+	defer server.Close()
+
+	// writeTimeout より長いサイクルでも結果を返す
+	resp, err := http.Post(server.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"status":"ok"`) {
+		t.Errorf("refresh = %d %s, want 200 ok", resp.StatusCode, body)
+	}
+}
+
+func TestHandleRefreshAbortsOnShutdown(t *testing.T) {
+	cfg := setupTest(t)
+	fake := newFakeDiscord()
+	fake.addMembers("g1", 2, 0)
+	fake.addChannel("g1", "101", "general", 3)
+	started := make(chan struct{})
+	fake.fail = func(ctx context.Context, method, id string) error {
+		if method == "GuildMembers" {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	discordSession = fake
+	t.Cleanup(func() { discordSession = nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handleRefresh(ctx, cfg)(rec, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+		close(done)
+	}()
+	<-started
+	// 終了するときは実行中のサイクルを中断する
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("refresh did not return after shutdown")
+	}
+	if !strings.Contains(rec.Body.String(), `"status":"partial"`) {
+		t.Errorf("refresh = %s, want partial", rec.Body.String())
+	}
+}
+
+func TestMetricsHandlerNegotiatesOpenMetrics(t *testing.T) {
+	const accept = "application/openmetrics-text; version=1.0.0"
+	for _, test := range []struct {
+		enabled bool
+		want    string
+	}{
+		{true, "application/openmetrics-text"},
+		{false, "text/plain"},
+	} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "A gauge"}))
+		server := httptest.NewServer(newMetricsHandler(&Config{EnableOpenMetrics: test.enabled}, registry))
+
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, test.want) {
+			t.Errorf("enableOpenMetrics=%v: Content-Type = %q, want %s", test.enabled, got, test.want)
+		}
+		// OpenMetrics は # EOF で終わる
+		if got := strings.HasSuffix(string(body), "# EOF\n"); got != test.enabled {
+			t.Errorf("enableOpenMetrics=%v: body ends with # EOF = %v", test.enabled, got)
+		}
+	}
+}
+
+func TestMetricsHandlerFiltersByChannel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	perChannel := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_channel_messages", Help: "Per channel"}, []string{"channel"})
+	perGuild := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_guild_messages", Help: "Per guild"}, []string{"guild"})
+	registry.MustRegister(perChannel, perGuild)
+	perChannel.WithLabelValues("general").Set(3)
+	perChannel.WithLabelValues("random").Set(5)
+	perGuild.WithLabelValues("g1").Set(8)
+	handler := newMetricsHandler(&Config{}, registry)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics?channel=general", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `test_channel_messages{channel="general"} 3`) {
+		t.Fatalf("?channel=general = %d %q, want the general series", w.Code, body)
+	}
+	// 他のチャンネルやチャンネルのラベルがない系列は出さない
+	for _, unwanted := range []string{`channel="random"`, "test_guild_messages"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("?channel=general served %s", unwanted)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics?channel=nope", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("?channel=nope status = %d, want 400", w.Code)
+	}
+}
+
+func TestListenMetricsPortInUse(t *testing.T) {
+	ln, err := listenMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// 使用中のポートは起動時にエラーにする
+	_, err = listenMetrics(ln.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "can't bind metricsPort") {
+		t.Errorf("err = %v, want the port in use reported", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxTopTalkers bounds topTalkers, since every talker adds one
+// discord_user_message_count series per channel.
+const maxTopTalkers = 25
+
+var userMessageCountGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_user_message_count",
+		Help: "Number of messages per channel by its most active users",
+	},
+	[]string{"channel", "user"},
+)
+
+// updateTopTalkers replaces the channel's discord_user_message_count series
+// with the topTalkers users who posted the most messages in it. authors are
+// keyed by user ID, and the series are labelled with the names.
+func updateTopTalkers(channel *discordgo.Channel, authors map[string]int, names map[string]string) {
+	userMessageCountGauge.DeletePartialMatch(prometheus.Labels{"channel": channel.Name})
+	for _, user := range topKeys(authors, config.TopTalkers) {
+		userMessageCountGauge.WithLabelValues(channel.Name, names[user]).Set(float64(authors[user]))
+	}
+}
+
+// topKeys returns the n keys with the highest counts, ties broken by key so
+// that the selection is stable across cycles.
+func topKeys(counts map[string]int, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateTopTalkers(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.TopTalkers = 2
+	userMessageCountGauge.Reset()
+	general := &discordgo.Channel{ID: "101", Name: "general"}
+
+	names := map[string]string{"1": "alice", "2": "bob", "3": "carol", "4": "dave", "5": "erin"}
+
+	updateTopTalkers(general, map[string]int{"1": 3, "3": 2, "2": 2, "4": 1}, names)
+	wantSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "alice"}, 3)
+	// 同数なら ID 順で選ぶ
+	wantSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "bob"}, 2)
+	wantNoSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "carol"})
+
+	// 上位から外れたユーザーの系列は消える
+	updateTopTalkers(general, map[string]int{"1": 1, "4": 5, "5": 4}, names)
+	wantSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "dave"}, 5)
+	wantSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "erin"}, 4)
+	wantNoSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "alice"})
+	wantNoSeries(t, userMessageCountGauge, prometheus.Labels{"channel": "general", "user": "bob"})
+}
+
+func TestCountChannelMessagesCountsAuthorsByID(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.TopTalkers = 5
+	fake := newFakeDiscord()
+	messages := fakeMessages(3)
+	// 名前を変えたユーザーは新しい名前で 1 人として数え、元の名前を使う別のユーザーとは分ける
+	messages[0].Author = &discordgo.User{ID: "1000", Username: "alice2"}
+	messages[2].Author = &discordgo.User{ID: "2000", Username: "alice"}
+	fake.messages["c1"] = messages
+
+	stats, err := countChannelMessages(context.Background(), fake, "c1", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.authors["1000"] != 2 || stats.authors["2000"] != 1 {
+		t.Errorf("authors = %v, want 2 by 1000 and 1 by 2000", stats.authors)
+	}
+	if stats.authorNames["1000"] != "alice2" || stats.authorNames["2000"] != "alice" {
+		t.Errorf("authorNames = %v, want alice2 for 1000 and alice for 2000", stats.authorNames)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var threadMessageCountGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_thread_message_count",
+		Help: "Number of messages per active thread, including forum posts",
+	},
+	[]string{"channel", "thread", "thread_id"},
+)
+
+// listActiveThreads returns the active threads of the listed guilds whose
+// parent is one of the counted text or forum channels, along with those of
+// listed, the threads GuildChannels returned, each once. Threads are counted
+// on their own and never added to their parent's count. If the threads of a
+// guild can't be listed, the ones known from the previous cycle are returned
+// instead and it reports false.
+func listActiveThreads(ctx context.Context, discordSession discordClient, listedGuilds map[string]bool, parents map[string]*discordgo.Channel, listed []*discordgo.Channel) ([]*discordgo.Channel, bool) {
+	var threads []*discordgo.Channel
+	seen := make(map[string]bool)
+	add := func(thread *discordgo.Channel) {
+		if _, ok := parents[thread.ParentID]; ok && !seen[thread.ID] && !isExcludedChannel(thread) {
+			seen[thread.ID] = true
+			threads = append(threads, thread)
+		}
+	}
+	ok := true
+	for serverID := range listedGuilds {
+		list, err := withRetry(ctx, "get active threads", func() (*discordgo.ThreadsList, error) {
+			apiRequestsCounter.WithLabelValues("GuildThreadsActive").Inc()
+			return discordSession.GuildThreadsActive(serverID, discordgo.WithContext(ctx))
+		})
+		if err != nil {
+			scrapeErrorsCounter.WithLabelValues(metricGroupMessages).Inc()
+			slog.Error("Failed to get active threads", "guild", serverID, "error", err)
+			ok = false
+			// 前回のスレッドを数え続けて、系列が消えないようにする
+			for _, previous := range knownChannels {
+				if previous.IsThread() && previous.GuildID == serverID {
+					threads = append(threads, previous)
+					seen[previous.ID] = true
+				}
+			}
+			continue
+		}
+		for _, thread := range list.Threads {
+			add(thread)
+		}
+	}
+	// Gateway の intent によっては GuildChannels にもアクティブなスレッドが含まれる
+	for _, thread := range listed {
+		add(thread)
+	}
+	return threads, ok
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// addThread adds an active public thread of parentID with n fake messages to
+// the guild.
+func (f *fakeDiscord) addThread(guildID, id, parentID, name string, n int) *discordgo.Channel {
+	messages := fakeMessages(n)
+	thread := fakeTextChannel(guildID, id, name, messages)
+	thread.Type = discordgo.ChannelTypeGuildPublicThread
+	thread.ParentID = parentID
+	f.threads[guildID] = append(f.threads[guildID], thread)
+	f.messages[id] = messages
+	return thread
+}
+
+func TestUpdateMessageCountCountsThreads(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.IncludeThreads = true
+	fake := newFakeDiscord()
+	general := fake.addChannel("g1", "101", "general", 4)
+	fake.addThread("g1", "301", general.ID, "question", 2)
+	fake.addThread("g1", "302", general.ID, "bug report", 3)
+
+	if _, ok := updateMessageCount(context.Background(), fake, []string{"g1"}); !ok {
+		t.Fatal("updateMessageCount reported a failure")
+	}
+	wantSeries(t, threadMessageCountGauge, prometheus.Labels{"channel": "general", "thread": "question", "thread_id": "301"}, 2)
+	wantSeries(t, threadMessageCountGauge, prometheus.Labels{"channel": "general", "thread": "bug report", "thread_id": "302"}, 3)
+	// スレッドのメッセージは親チャンネルや合計には足さない
+	wantSeries(t, messageCountGauge, messageCountLabels(general), 4)
+	wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 4)
+}
+
+func TestUpdateMessageCountCountsForumPosts(t *testing.T) {
+	cfg := setupTest(t)
+	cfg.IncludeThreads = true
+	fake := newFakeDiscord()
+	forum := &discordgo.Channel{ID: "401", GuildID: "g1", Name: "help", Type: discordgo.ChannelTypeGuildForum}
+	fake.channels["g1"] = append(fake.channels["g1"], forum)
+	fake.addThread("g1", "302", forum.ID, "how do I", 6)
+
+	updateMessageCount(context.Background(), fake, []string{"g1"})
+	wantSeries(t, threadMessageCountGauge, prometheus.Labels{"channel": "help", "thread": "how do I", "thread_id": "302"}, 6)
+	// フォーラム自体にはメッセージがない
+	wantNoSeries(t, messageCountGauge, messageCountLabels(forum))
+}
+
+func TestUpdateMessageCountThreadsInChannelList(t *testing.T) {
+	for _, includeThreads := range []bool{false, true} {
+		cfg := setupTest(t)
+		cfg.IncludeThreads = includeThreads
+		fake := newFakeDiscord()
+		general := fake.addChannel("g1", "101", "general", 4)
+		thread := fake.addThread("g1", "301", general.ID, "question", 2)
+		// インテントによっては GuildChannels にもスレッドが含まれる
+		private := *thread
+		private.ID, private.Name, private.Type = "302", "secret", discordgo.ChannelTypeGuildPrivateThread
+		fake.messages["302"] = fakeMessages(1)
+		fake.channels["g1"] = append(fake.channels["g1"], thread, &private)
+
+		results, _ := updateMessageCount(context.Background(), fake, []string{"g1"})
+		wantSeries(t, messageCountGauge, messageCountLabels(general), 4)
+		wantSeries(t, messageCountTotalGauge, prometheus.Labels{"guild": "g1"}, 4)
+		// スレッドは除外したチャンネルには数えない
+		wantSeries(t, channelsExcludedGauge, prometheus.Labels{"guild": "g1"}, 0)
+		if includeThreads {
+			// 一覧とアクティブなスレッドの両方にあっても 1 回だけ数える
+			if got := fake.callCount("ChannelMessages"); got != 3 {
+				t.Errorf("ChannelMessages called %d times with includeThreads, want once for general and each thread", got)
+			}
+			wantSeries(t, threadMessageCountGauge, prometheus.Labels{"channel": "general", "thread": "question", "thread_id": "301"}, 2)
+			wantSeries(t, threadMessageCountGauge, prometheus.Labels{"channel": "general", "thread": "secret", "thread_id": "302"}, 1)
+		} else {
+			if len(results) != 1 {
+				t.Errorf("counted %d channels without includeThreads, want only general", len(results))
+			}
+			if got := fake.callCount("ChannelMessages"); got != 1 {
+				t.Errorf("ChannelMessages called %d times without includeThreads, want 1", got)
+			}
+		}
+	}
+}
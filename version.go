@@ -0,0 +1,18 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Version and Commit are set at build time with
+// -ldflags "-X main.Version=... -X main.Commit=...".
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+var buildInfoGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_exporter_build_info",
+		Help: "Always 1, labelled with the version, commit and Go version the exporter was built with",
+	},
+	[]string{"version", "commit", "go_version"},
+)
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var voiceChannelMembersGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "discord_voice_channel_members",
+		Help: "Number of members currently connected to each voice channel",
+	},
+	[]string{"channel"},
+)
+
+// updateVoiceChannelMembers counts the voice states the gateway has delivered
+// per voice channel. Channels nobody is connected to are exported as 0, so
+// the series don't come and go with the occupants; the series of channels that
+// no longer exist are removed.
+func updateVoiceChannelMembers(state *discordgo.State, serverIDs []string) {
+	counts := make(map[string]int)
+	for _, serverID := range serverIDs {
+		// state.Guild はそれ自体で読み取りロックを取るので、ロックを持ったまま呼ばない
+		guild, err := state.Guild(serverID)
+		if err != nil {
+			slog.Error("Failed to get guild voice states", "guild", serverID, "error", err)
+			continue
+		}
+		state.RLock()
+		occupants := make(map[string]int, len(guild.VoiceStates))
+		for _, voiceState := range guild.VoiceStates {
+			occupants[voiceState.ChannelID]++
+		}
+		for _, channel := range guild.Channels {
+			if channel.Type != discordgo.ChannelTypeGuildVoice || isExcludedChannel(channel) {
+				continue
+			}
+			counts[channel.Name] += occupants[channel.ID]
+		}
+		state.RUnlock()
+	}
+
+	// ボイスチャンネルがなくなったときも前の系列を残さない
+	voiceChannelMembersGauge.Reset()
+	for name, count := range counts {
+		voiceChannelMembersGauge.WithLabelValues(name).Set(float64(count))
+	}
+}
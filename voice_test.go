@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateVoiceChannelMembers(t *testing.T) {
+	setupTest(t)
+	state := stateWithGuild(t, &discordgo.Guild{
+		ID: "g1",
+		Channels: []*discordgo.Channel{
+			{ID: "201", GuildID: "g1", Name: "lounge", Type: discordgo.ChannelTypeGuildVoice},
+			{ID: "202", GuildID: "g1", Name: "gaming", Type: discordgo.ChannelTypeGuildVoice},
+			{ID: "101", GuildID: "g1", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		},
+		VoiceStates: []*discordgo.VoiceState{
+			{GuildID: "g1", ChannelID: "201", UserID: "1"},
+			{GuildID: "g1", ChannelID: "201", UserID: "2"},
+			{GuildID: "g1", ChannelID: "201", UserID: "3"},
+		},
+	})
+
+	updateVoiceChannelMembers(state, []string{"g1"})
+	wantSeries(t, voiceChannelMembersGauge, prometheus.Labels{"channel": "lounge"}, 3)
+	// 誰もいないボイスチャンネルも 0 として出す
+	wantSeries(t, voiceChannelMembersGauge, prometheus.Labels{"channel": "gaming"}, 0)
+	wantNoSeries(t, voiceChannelMembersGauge, prometheus.Labels{"channel": "general"})
+}
+
+func TestUpdateVoiceChannelMembersClearsRemovedChannels(t *testing.T) {
+	setupTest(t)
+	updateVoiceChannelMembers(stateWithGuild(t, &discordgo.Guild{
+		ID:       "g1",
+		Channels: []*discordgo.Channel{{ID: "201", GuildID: "g1", Name: "lounge", Type: discordgo.ChannelTypeGuildVoice}},
+	}), []string{"g1"})
+	wantSeries(t, voiceChannelMembersGauge, prometheus.Labels{"channel": "lounge"}, 0)
+
+	// 最後のボイスチャンネルが消えたら系列も消す
+	updateVoiceChannelMembers(stateWithGuild(t, &discordgo.Guild{ID: "g1"}), []string{"g1"})
+	wantNoSeries(t, voiceChannelMembersGauge, prometheus.Labels{"channel": "lounge"})
+}
+
+func TestUpdateVoiceChannelMembersWithConcurrentStateUpdates(t *testing.T) {
+	setupTest(t)
+	state := stateWithGuild(t, &discordgo.Guild{
+		ID:          "g1",
+		Channels:    []*discordgo.Channel{{ID: "201", GuildID: "g1", Name: "lounge", Type: discordgo.ChannelTypeGuildVoice}},
+		VoiceStates: []*discordgo.VoiceState{{GuildID: "g1", ChannelID: "201", UserID: "1"}},
+	})
+
+	stop := writePresences(t, state, "g1")
+	runWithin(t, func() {
+		for i := 0; i < 1000; i++ {
+			updateVoiceChannelMembers(state, []string{"g1"})
+		}
+	})
+	stop()
+	wantSeries(t, voiceChannelMembersGauge, prometheus.Labels{"channel": "lounge"}, 1)
+}